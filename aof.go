@@ -0,0 +1,506 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AOFSyncPolicy string
+
+var (
+	// AOFSyncAlways fsyncs before a write is acknowledged, concurrent writes share an fsync
+	AOFSyncAlways AOFSyncPolicy = "always"
+	// AOFSyncEverySec fsyncs once per second in the background
+	AOFSyncEverySec AOFSyncPolicy = "everysec"
+	// AOFSyncNo leaves flushing to the operating system
+	AOFSyncNo AOFSyncPolicy = "no"
+)
+
+const (
+	// defaultAOFRewritePercentage triggers a rewrite when the AOF doubled since the last one
+	defaultAOFRewritePercentage = 100
+	// defaultAOFRewriteMinSize is the size below which the AOF is never rewritten automatically
+	defaultAOFRewriteMinSize = 64 * 1024 * 1024
+	// aofRewriteItemsPerCmd bounds the members written by a single rewritten command
+	aofRewriteItemsPerCmd = 64
+)
+
+var errAOFRewriteInProgress = errors.New("background append only file rewriting already in progress")
+
+// An AOF record is "#<crc>" followed by a space, the command and a newline,
+// crc being the 8 hex digit CRC-32 of the command. Lines without the leading
+// "#" are records of files written before checksums and are not verified.
+const aofRecordPrefix = '#'
+
+func encodeAOFRecord(cmd string) string {
+	return fmt.Sprintf("%c%08x %s\n", aofRecordPrefix, crc32.ChecksumIEEE([]byte(cmd)), cmd)
+}
+
+// AOFCorruptError reports the first invalid record of an AOF, Tail is set when
+// it is the last record of the file, as left by a crash during a write, and
+// Preamble when the RDB preamble is invalid.
+type AOFCorruptError struct {
+	Offset   int64
+	Tail     bool
+	Preamble bool
+	Reason   string
+}
+
+func (e *AOFCorruptError) Error() string {
+	if e.Preamble {
+		return fmt.Sprintf("corrupted rdb preamble: %s", e.Reason)
+	}
+	if e.Tail {
+		return fmt.Sprintf("torn record at offset %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("corrupted record at offset %d: %s", e.Offset, e.Reason)
+}
+
+// decodeAOFRecord verifies and parses one record without its newline.
+func decodeAOFRecord(line string) (*Cmd, error) {
+	if len(line) > 0 && line[0] == aofRecordPrefix {
+		sum, cmd, ok := strings.Cut(line[1:], " ")
+		if !ok || len(sum) != 8 {
+			return nil, errors.New("malformed checksum")
+		}
+		want, err := strconv.ParseUint(sum, 16, 32)
+		if err != nil {
+			return nil, errors.New("malformed checksum")
+		}
+		if crc32.ChecksumIEEE([]byte(cmd)) != uint32(want) {
+			return nil, errors.New("checksum mismatch")
+		}
+		line = cmd
+	}
+	return NewCmd(line)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scanAOF calls fn with every record of r and returns the number of records
+// and the size of the valid prefix. An AOF rewritten with a preamble starts
+// with an RDB snapshot whose entries are passed to load first. An invalid
+// record stops the scan with an *AOFCorruptError, errors of load and fn are
+// returned as is.
+func scanAOF(r io.Reader, load func(entries []rdbEntry) error, fn func(cmd *Cmd) error) (records int, valid int64, err error) {
+	cr := &countingReader{r: r}
+	reader := bufio.NewReader(cr)
+	if b, _ := reader.Peek(len(rdbMagic)); string(b) == rdbMagic {
+		entries, _, err := decodeRDB(reader)
+		if err != nil {
+			return 0, 0, &AOFCorruptError{Preamble: true, Reason: err.Error()}
+		}
+		if load != nil {
+			if err := load(entries); err != nil {
+				return 0, 0, err
+			}
+		}
+		valid = cr.n - int64(reader.Buffered())
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return records, valid, fmt.Errorf("read aof file line failed: %w", err)
+		}
+		if line == "" {
+			return records, valid, nil
+		}
+		if !strings.HasSuffix(line, "\n") {
+			return records, valid, &AOFCorruptError{Offset: valid, Tail: true, Reason: "record is not terminated"}
+		}
+		if record := strings.TrimSuffix(line, "\n"); record != "" {
+			cmd, err := decodeAOFRecord(record)
+			if err != nil {
+				_, peekErr := reader.Peek(1)
+				return records, valid, &AOFCorruptError{Offset: valid, Tail: errors.Is(peekErr, io.EOF), Reason: err.Error()}
+			}
+			if fn != nil {
+				if err := fn(cmd); err != nil {
+					return records, valid, err
+				}
+			}
+			records++
+		}
+		valid += int64(len(line))
+	}
+}
+
+// AOFCheckResult describes an AOF checked by CheckAOF.
+type AOFCheckResult struct {
+	Records int
+	// Size is the size of the file, Valid the size of its valid prefix
+	Size  int64
+	Valid int64
+	// Err is the first invalid record, nil when the file is valid
+	Err *AOFCorruptError
+	// Fixed is set when the file was truncated to its valid prefix
+	Fixed bool
+}
+
+// CheckAOF validates the AOF at path, with fix an invalid file is truncated
+// to its valid prefix, dropping every record from the first invalid one. A
+// file whose RDB preamble is invalid can not be repaired.
+func CheckAOF(path string, fix bool) (*AOFCheckResult, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &AOFCheckResult{Size: info.Size()}
+	result.Records, result.Valid, err = scanAOF(f, nil, nil)
+	if err != nil && !errors.As(err, &result.Err) {
+		return nil, err
+	}
+	if result.Err != nil && fix {
+		if result.Err.Preamble {
+			return nil, errors.New("the rdb preamble is corrupted, truncating would drop the whole file")
+		}
+		if err := f.Truncate(result.Valid); err != nil {
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+		result.Fixed = true
+	}
+	return result, nil
+}
+
+// aofWriter appends records to the AOF. With AOFSyncAlways records are
+// buffered and a single goroutine at a time writes and fsyncs everything
+// buffered so far, so writers arriving during an fsync are committed together
+// by the next one.
+type aofWriter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	f      *os.File
+	path   string
+	policy AOFSyncPolicy
+	buf    []byte
+	// size counts every appended byte, baseSize is the size after the last rewrite
+	size     int64
+	baseSize int64
+	// appended and durable count records, durable ones are known to be on disk
+	appended uint64
+	durable  uint64
+	syncing  bool
+	err      error
+	// rewriteBuf collects the records appended while a rewrite runs, nil otherwise
+	rewriteBuf []byte
+}
+
+func newAOFWriter(f *os.File, path string, size int64, policy AOFSyncPolicy) *aofWriter {
+	w := &aofWriter{f: f, path: path, policy: policy, size: size, baseSize: size}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// offset returns the size of the AOF including the records not written yet.
+func (w *aofWriter) offset() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// append adds a record, with AOFSyncAlways it returns once the record is on disk.
+func (w *aofWriter) append(record string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rewriteBuf != nil {
+		w.rewriteBuf = append(w.rewriteBuf, record...)
+	}
+	w.size += int64(len(record))
+	w.appended++
+	if w.policy != AOFSyncAlways {
+		_, err := w.f.WriteString(record)
+		return err
+	}
+	w.buf = append(w.buf, record...)
+	seq := w.appended
+	for w.durable < seq {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+		w.commit()
+	}
+	return nil
+}
+
+// commit writes and fsyncs the buffered records, it is called with mu held
+// and releases it during the IO.
+func (w *aofWriter) commit() {
+	f, buf, seq := w.f, w.buf, w.appended
+	w.buf = nil
+	w.syncing = true
+	w.mu.Unlock()
+	_, err := f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	w.mu.Lock()
+	w.syncing = false
+	if err != nil {
+		// the records may be partially written, later writes can not be acknowledged either
+		w.err = fmt.Errorf("aof fsync failed: %w", err)
+	} else if seq > w.durable {
+		w.durable = seq
+	}
+	w.cond.Broadcast()
+}
+
+// syncLoop fsyncs the AOF every second for AOFSyncEverySec.
+func (w *aofWriter) syncLoop(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		w.mu.Lock()
+		f := w.f
+		w.mu.Unlock()
+		// the file may be replaced by a rewrite meanwhile, it is synced by the rewrite then
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Printf("aof fsync failed: %s", err)
+		}
+	}
+}
+
+// close writes and fsyncs the pending records and closes the file.
+func (w *aofWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.err == nil && len(w.buf) > 0 {
+		_, w.err = w.f.Write(w.buf)
+		w.buf = nil
+	}
+	err := w.f.Sync()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	if w.err == nil {
+		w.err = os.ErrClosed
+	}
+	return err
+}
+
+// startRewrite starts collecting the records appended from now on.
+func (w *aofWriter) startRewrite() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rewriteBuf = []byte{}
+}
+
+// abortRewrite drops the records collected for a failed rewrite.
+func (w *aofWriter) abortRewrite() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rewriteBuf = nil
+}
+
+// finishRewrite appends the records collected during the rewrite to f, which
+// holds the rewritten keyspace, and atomically replaces the AOF with it.
+func (w *aofWriter) finishRewrite(f *os.File) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer func() { w.rewriteBuf = nil }()
+	// an fsync in flight still uses the old file
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if _, err := f.Write(w.rewriteBuf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), w.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		return err
+	}
+	_ = w.f.Close()
+	// records buffered for the old file are part of the rewrite buffer
+	w.f, w.buf = f, nil
+	w.size, w.baseSize = info.Size(), info.Size()
+	w.durable = w.appended
+	w.cond.Broadcast()
+	return nil
+}
+
+// rewriteAOF writes the keyspace as of one instant as a minimal command log,
+// or as an RDB preamble when enabled, followed by the writes made meanwhile,
+// and swaps it with the AOF.
+func (s *Server) rewriteAOF() (err error) {
+	if !s.aofRewriting.CompareAndSwap(false, true) {
+		return errAOFRewriteInProgress
+	}
+	defer s.aofRewriting.Store(false)
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(s.backupFile), filepath.Base(s.backupFile)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.aof.abortRewrite()
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	start := time.Now()
+	offset := s.beginSnapshot(s.aof.startRewrite)
+	bw := bufio.NewWriter(f)
+	if s.aofPreamble {
+		err = s.encodeSnapshot(bw, offset)
+	} else {
+		err = s.eachSnapshotKey(func(key string, value any, expireAt int64) error {
+			return writeRewriteEntry(bw, key, value, expireAt)
+		})
+	}
+	s.endSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := s.aof.finishRewrite(f); err != nil {
+		return err
+	}
+	log.Printf("Rewrote aof %s in %s", s.backupFile, time.Since(start))
+	return nil
+}
+
+// writeRewriteEntry writes the commands recreating one key, collections are
+// split into commands of at most aofRewriteItemsPerCmd members.
+func writeRewriteEntry(w io.Writer, key string, value any, expireAt int64) error {
+	var cmds [][]string
+	batch := func(name string, items []string, width int) {
+		for i := 0; i < len(items); i += aofRewriteItemsPerCmd * width {
+			end := min(i+aofRewriteItemsPerCmd*width, len(items))
+			cmds = append(cmds, append([]string{name, key}, items[i:end]...))
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		if expireAt > 0 {
+			// the deadline is part of the set, so it needs no separate command
+			cmds = append(cmds, []string{"set", key, v, "pxat", strconv.FormatInt(expireAt, 10)})
+			expireAt = 0
+		} else {
+			cmds = append(cmds, []string{"set", key, v})
+		}
+	case *List:
+		batch("rpush", v.All(), 1)
+	case *Set:
+		batch("sadd", v.Members(), 1)
+	case *Hash:
+		var items []string
+		for f, val := range v.All() {
+			items = append(items, f, val)
+		}
+		batch("hset", items, 2)
+	case *ZSet:
+		var items []string
+		for _, m := range v.Members() {
+			items = append(items, formatScore(m.Score), m.Member)
+		}
+		batch("zadd", items, 2)
+	default:
+		return fmt.Errorf("can not rewrite %s of type %T", key, value)
+	}
+	if expireAt > 0 && len(cmds) > 0 {
+		cmds = append(cmds, []string{"pexpireat", key, strconv.FormatInt(expireAt, 10)})
+	}
+	for _, args := range cmds {
+		if _, err := io.WriteString(w, encodeAOFRecord(EncodeCmd(args...))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleBGRewriteAOF starts a rewrite in the background.
+func (s *Server) handleBGRewriteAOF() (statusReply, error) {
+	if s.aof == nil {
+		return "", errors.New("append only file is not enabled")
+	}
+	if s.aofRewriting.Load() {
+		return "", errAOFRewriteInProgress
+	}
+	s.goBackground(func() {
+		if err := s.rewriteAOF(); err != nil {
+			log.Printf("background aof rewrite failed: %s", err)
+		}
+	})
+	return "Background append only file rewriting started", nil
+}
+
+// aofRewriteCron starts a rewrite when the AOF grew by percentage since the
+// last rewrite and is at least minSize bytes, a zero percentage disables it.
+func (s *Server) aofRewriteCron(ctx context.Context, percentage int, minSize int64) {
+	if percentage <= 0 {
+		return
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.aof.mu.Lock()
+		size, base := s.aof.size, s.aof.baseSize
+		s.aof.mu.Unlock()
+		if size < minSize || size < base+base*int64(percentage)/100 || s.aofRewriting.Load() {
+			continue
+		}
+		log.Printf("Starting automatic aof rewrite, %d bytes grew from %d", size, base)
+		if err := s.rewriteAOF(); err != nil && !errors.Is(err, errAOFRewriteInProgress) {
+			log.Printf("automatic aof rewrite failed: %s", err)
+		}
+	}
+}
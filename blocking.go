@@ -0,0 +1,245 @@
+package kvstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errClientGone   = errors.New("client closed the connection")
+)
+
+// blockingKeys keeps the commands blocked on empty lists. Every key has a
+// FIFO queue of waiters, only the first waiter of a key pops from it, so the
+// waiters are served in the order they blocked.
+type blockingKeys struct {
+	mu      sync.Mutex
+	waiters map[string][]*keyWaiter
+	// blocked is the number of waiters, signal skips the lock when it is zero
+	blocked atomic.Int64
+}
+
+// keyWaiter is a blocked command, ready receives a token when one of its keys
+// may have data.
+type keyWaiter struct {
+	ready chan struct{}
+}
+
+func (b *blockingKeys) add(w *keyWaiter, keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiters == nil {
+		b.waiters = map[string][]*keyWaiter{}
+	}
+	for _, key := range keys {
+		b.waiters[key] = append(b.waiters[key], w)
+	}
+	b.blocked.Add(1)
+}
+
+func (b *blockingKeys) remove(w *keyWaiter, keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		queue := slices.DeleteFunc(b.waiters[key], func(x *keyWaiter) bool { return x == w })
+		if len(queue) == 0 {
+			delete(b.waiters, key)
+		} else {
+			b.waiters[key] = queue
+		}
+	}
+	b.blocked.Add(-1)
+}
+
+// first reports whether w is the first waiter of key.
+func (b *blockingKeys) first(w *keyWaiter, key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queue := b.waiters[key]
+	return len(queue) > 0 && queue[0] == w
+}
+
+// signal wakes the first waiter of every key, it is called after a command
+// pushed to keys.
+func (b *blockingKeys) signal(keys []string) {
+	if b.blocked.Load() == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		if queue := b.waiters[key]; len(queue) > 0 {
+			select {
+			case queue[0].ready <- struct{}{}:
+			default:
+				// a wake up is already pending
+			}
+		}
+	}
+}
+
+// pushedKeys returns the lists cmd pushed elements to, resp is its reply. Only
+// they wake up waiters, a blocked command retrying its pop on an empty list
+// does not wake itself.
+func pushedKeys(cmd *Cmd, resp any) []string {
+	switch cmd.Name {
+	case "lpush", "rpush", "linsert":
+		return cmd.Args[:1]
+	case "lmove", "rpoplpush":
+		if resp != nil {
+			return cmd.Args[1:2]
+		}
+	}
+	return nil
+}
+
+// isBlocking reports whether cmd may block the connection.
+func isBlocking(cmd *Cmd) bool {
+	switch cmd.Name {
+	case "blpop", "brpop", "blmove":
+		return true
+	}
+	return false
+}
+
+// parseBlockingTimeout parses a timeout in seconds, 0 blocks forever.
+func parseBlockingTimeout(arg string) (time.Duration, error) {
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid timeout value: %s", arg)
+	}
+	if v < 0 {
+		return 0, errors.New("timeout is negative")
+	}
+	return time.Duration(v * float64(time.Second)), nil
+}
+
+// executeConn runs a command received on conn. A blocking command gives up
+// once the client closed conn, so it never pops an element nobody receives.
+func (s *Server) executeConn(conn net.Conn, reader *bufio.Reader, cmd *Cmd) (any, error) {
+	if !isBlocking(cmd) {
+		return s.execute(cmd)
+	}
+	gone, stop := s.watchConn(conn, reader)
+	defer stop()
+	return s.executeBlocking(cmd, gone)
+}
+
+// watchConn closes gone when the client closes conn, until stop is called.
+// Data the client sends meanwhile stays buffered in reader.
+func (s *Server) watchConn(conn net.Conn, reader *bufio.Reader) (gone <-chan struct{}, stop func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(closed)
+		}
+	}()
+	return closed, func() {
+		// the shutdown sets the read deadlines under connsMu after closing s.closing
+		s.connsMu.Lock()
+		defer s.connsMu.Unlock()
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		select {
+		case <-s.closing:
+		default:
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// executeBlocking serves BLPOP key [key ...] timeout, BRPOP key [key ...]
+// timeout and BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout. The
+// pop is run as the LPOP, RPOP or LMOVE it stands for, every time the
+// command is woken up, so only those reach the AOF and the Raft log. The
+// command replies nil once timeout elapsed, and gives up when gone is closed.
+func (s *Server) executeBlocking(cmd *Cmd, gone <-chan struct{}) (any, error) {
+	var keys []string
+	var pop func(key string) *Cmd
+	var timeoutArg string
+	switch cmd.Name {
+	case "blpop", "brpop":
+		if len(cmd.Args) < 2 {
+			return nil, fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		keys = cmd.Args[:len(cmd.Args)-1]
+		timeoutArg = cmd.Args[len(cmd.Args)-1]
+		name := cmd.Name[1:]
+		pop = func(key string) *Cmd { return NewCmdArgs([]string{name, key, "1"}) }
+	case "blmove":
+		if len(cmd.Args) != 5 {
+			return nil, fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		for _, end := range cmd.Args[2:4] {
+			if _, err := parseListEnd(end); err != nil {
+				return nil, err
+			}
+		}
+		keys = cmd.Args[:1]
+		timeoutArg = cmd.Args[4]
+		pop = func(string) *Cmd { return NewCmdArgs(append([]string{"lmove"}, cmd.Args[:4]...)) }
+	}
+	timeout, err := parseBlockingTimeout(timeoutArg)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &keyWaiter{ready: make(chan struct{}, 1)}
+	s.blocked.add(w, keys)
+	defer func() {
+		s.blocked.remove(w, keys)
+		// the wake up w may have taken goes to the next waiter
+		s.blocked.signal(keys)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-gone:
+			return nil, errClientGone
+		default:
+		}
+		for _, key := range keys {
+			if !s.blocked.first(w, key) {
+				continue
+			}
+			resp, err := s.execute(pop(key))
+			if err != nil {
+				return nil, err
+			}
+			switch v := resp.(type) {
+			case []string:
+				if len(v) > 0 {
+					return []string{key, v[0]}, nil
+				}
+			case string:
+				return v, nil
+			}
+		}
+		select {
+		case <-w.ready:
+		case <-expired:
+			return nil, nil
+		case <-s.closing:
+			return nil, errShuttingDown
+		case <-gone:
+			return nil, errClientGone
+		}
+	}
+}
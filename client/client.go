@@ -1,57 +1,144 @@
 package client
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"github.com/zhan3333/kystore"
 	"net"
-	"strings"
+	"time"
 )
 
+// DefaultMaxReplySize is the reply size limit used when Options.MaxReplySize is not set.
+const DefaultMaxReplySize = 512 * 1024 * 1024
+
+// ErrReplyTooLarge is returned when a reply exceeds Options.MaxReplySize, the
+// connection is closed and reopened by the next command.
+var ErrReplyTooLarge = errors.New("reply exceeds the max reply size")
+
+// Nil is returned when the reply is empty, such as the score of a missing
+// sorted set member.
+var Nil = errors.New("kvstore: nil")
+
+type Options struct {
+	// MaxReplySize limits the bytes of a single reply, defaults to DefaultMaxReplySize
+	MaxReplySize int
+}
+
 type Client struct {
-	conn *net.TCPConn
+	addr    string
+	options Options
+	conn    *net.TCPConn
+	reader  *replyReader
 	cmdable
 }
 
 func NewClient(serverAddr string) (*Client, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", serverAddr)
-	if err != nil {
-		return nil, err
+	return NewClientWithOptions(serverAddr, nil)
+}
+
+func NewClientWithOptions(serverAddr string, options *Options) (*Client, error) {
+	cli := &Client{addr: serverAddr}
+	if options != nil {
+		cli.options = *options
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
+	if cli.options.MaxReplySize <= 0 {
+		cli.options.MaxReplySize = DefaultMaxReplySize
+	}
+	if err := cli.dial(); err != nil {
 		return nil, err
 	}
-	cli := &Client{conn: conn}
 	cli.cmdable = cli.process
 	return cli, nil
 }
 
+func (c *Client) dial() error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = &replyReader{r: bufio.NewReader(conn), max: c.options.MaxReplySize}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// process runs cmd and honours ctx: once ctx is done the connection is
+// interrupted, cmd fails with the error of ctx and the connection is reopened
+// by the next command.
 func (c *Client) process(ctx context.Context, cmd Cmder) error {
-	if err := send(c.conn, cmd.String()); err != nil {
+	if err := ctx.Err(); err != nil {
 		cmd.SetErr(err)
 		return err
 	}
-
-	if resp, err := receive(c.conn); err != nil {
+	if err := c.roundTrip(ctx, cmd); err != nil {
 		cmd.SetErr(err)
 		return err
-	} else {
-		cmd.setReplay(resp)
-		return nil
 	}
+	return nil
 }
 
-func send(conn *net.TCPConn, s string) error {
-	_, err := conn.Write([]byte(s + kvstore.LineSuffix))
-	return err
-}
+func (c *Client) roundTrip(ctx context.Context, cmd Cmder) error {
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return err
+		}
+	}
+	conn := c.conn
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+		close(interrupted)
+	})
+	defer func() {
+		if !stop() {
+			// the reply was read in full when the command did not fail
+			<-interrupted
+			_ = conn.SetDeadline(time.Time{})
+		}
+	}()
 
-func receive(conn *net.TCPConn) (string, error) {
-	reply := make([]byte, 1024)
+	if err := send(c.conn, cmd.String()); err != nil {
+		_ = c.Close()
+		return contextErr(ctx, err)
+	}
+
+	c.reader.reset()
+	if err := cmd.readReply(c.reader); err != nil {
+		var replyErr replyError
+		if !errors.As(err, &replyErr) && !errors.Is(err, Nil) {
+			// the rest of the reply is still on the wire, so the connection can not be reused
+			_ = c.Close()
+		}
+		return contextErr(ctx, err)
+	}
+	return nil
+}
 
-	if n, err := conn.Read(reply); err != nil {
-		return "", err
-	} else {
-		return strings.TrimSuffix(string(reply[:n]), kvstore.LineSuffix), nil
+// contextErr returns the error of ctx instead of err once ctx is done, err is
+// then the interrupted read or write.
+func contextErr(ctx context.Context, err error) error {
+	var replyErr replyError
+	if ctx.Err() != nil && !errors.As(err, &replyErr) && !errors.Is(err, Nil) {
+		return ctx.Err()
 	}
+	return err
+}
+
+func send(conn *net.TCPConn, s string) error {
+	_, err := conn.Write([]byte(s + kvstore.LineSuffix))
+	return err
 }
@@ -1,10 +1,18 @@
 package client_test
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"github.com/zhan3333/kystore/client"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,6 +53,63 @@ func TestMain(m *testing.M) {
 	cancel()
 }
 
+// startTestServer runs a server until the test ends or the returned stop is called.
+func startTestServer(t *testing.T, addr string, options *kvstore.ServerOptions) (*kvstore.Server, func()) {
+	server := kvstore.New(addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	startedCh := make(chan struct{}, 1)
+	stoppedCh := make(chan struct{})
+	options.StartedCh = startedCh
+	go func() {
+		defer close(stoppedCh)
+		_ = server.Run(ctx, options)
+	}()
+	select {
+	case <-startedCh:
+	case <-stoppedCh:
+		t.Fatalf("server %s stopped before it started", addr)
+	}
+	stop := func() {
+		cancel()
+		<-stoppedCh
+	}
+	t.Cleanup(stop)
+	return server, stop
+}
+
+// backupServer starts servers on addr that keep their backup in the same
+// temporary directory, so a test restarts a server on the data it persisted.
+type backupServer struct {
+	*kvstore.Server
+	t          *testing.T
+	addr       string
+	path       string
+	backupType kvstore.BackupType
+	configure  func(options *kvstore.ServerOptions)
+	stop       func()
+}
+
+// newBackupServer returns a backupServer, configure sets the options a test
+// changes on every start, it may be nil.
+func newBackupServer(t *testing.T, addr string, backupType kvstore.BackupType, configure func(options *kvstore.ServerOptions)) *backupServer {
+	return &backupServer{t: t, addr: addr, path: t.TempDir(), backupType: backupType, configure: configure}
+}
+
+// start starts a server and returns a client connected to it.
+func (s *backupServer) start() *client.Client {
+	s.t.Helper()
+	options := &kvstore.ServerOptions{Backup: true, BackupType: s.backupType, BackupPath: s.path}
+	if s.configure != nil {
+		s.configure(options)
+	}
+	s.Server, s.stop = startTestServer(s.t, s.addr, options)
+	c, err := client.NewClient(s.addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return c
+}
+
 func TestPing(t *testing.T) {
 	if val, err := cli.Ping(context.Background()).Result(); err != nil {
 		t.Fatal(err)
@@ -279,6 +344,29 @@ func TestLRange(t *testing.T) {
 			assert.Equal(t, []string{"val2", "val"}, val)
 		}
 	})
+
+	t.Run("negative start", func(t *testing.T) {
+		assert.NoError(t, cli.RPush(context.Background(), t.Name(), "a", "b", "c").Err())
+
+		if val, err := cli.LRange(context.Background(), t.Name(), -2, -1).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{"b", "c"}, val)
+		}
+
+		// out of range indexes are clamped
+		if val, err := cli.LRange(context.Background(), t.Name(), -100, 100).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{"a", "b", "c"}, val)
+		}
+
+		if val, err := cli.LRange(context.Background(), t.Name(), 0, -100).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 0, len(val))
+		}
+	})
 }
 
 func TestCmdable_LTrim(t *testing.T) {
@@ -384,6 +472,436 @@ func TestCmdable_LIndex(t *testing.T) {
 			assert.Equal(t, "val", val)
 		}
 	})
+
+	t.Run("out of negative index", func(t *testing.T) {
+		assert.NoError(t, cli.LPush(context.Background(), t.Name(), "val").Err())
+		if val, err := cli.LIndex(context.Background(), t.Name(), -2).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "", val)
+		}
+	})
+}
+
+func TestListConcurrent(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+	const clients, pushes = 16, 100
+	var mu sync.Mutex
+	popped := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := client.NewClient(serverAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() { _ = c.Close() }()
+			for j := 0; j < pushes; j++ {
+				val := fmt.Sprintf("%d-%d", i, j)
+				push := c.RPush
+				if j%2 == 0 {
+					push = c.LPush
+				}
+				assert.NoError(t, push(ctx, key, val).Err())
+				if j%4 == 0 {
+					values, err := c.LPop(ctx, key, 1).Result()
+					assert.NoError(t, err)
+					mu.Lock()
+					for _, v := range values {
+						popped[v]++
+					}
+					mu.Unlock()
+				}
+				assert.NoError(t, c.LRange(ctx, key, 0, -1).Err())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every pushed value is either popped once or still in the list
+	remaining, err := cli.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := popped
+	for _, v := range remaining {
+		seen[v]++
+	}
+	assert.Len(t, seen, clients*pushes)
+	for v, n := range seen {
+		assert.Equal(t, 1, n, v)
+	}
+	if val, err := cli.LLen(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, len(remaining), val)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+	assert.NoError(t, cli.RPush(ctx, key, "a", "b", "c", "b", "d", "b").Err())
+
+	if val, err := cli.RPop(ctx, key, 2).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"b", "d"}, val)
+	}
+
+	assert.NoError(t, cli.LSet(ctx, key, -1, "e").Err())
+	assert.Error(t, cli.LSet(ctx, key, 10, "x").Err())
+	assert.Error(t, cli.LSet(ctx, uuid.NewString(), 0, "x").Err())
+
+	if val, err := cli.LInsertBefore(ctx, key, "b", "x").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 5, val)
+	}
+	if val, err := cli.LInsertAfter(ctx, key, "e", "b").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 6, val)
+	}
+	if val, err := cli.LInsert(ctx, key, "before", "missing", "y").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, -1, val)
+	}
+	if val, err := cli.LRange(ctx, key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"a", "x", "b", "c", "e", "b"}, val)
+	}
+
+	if val, err := cli.LPos(ctx, key, "b", client.LPosArgs{}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2, val)
+	}
+	if val, err := cli.LPos(ctx, key, "b", client.LPosArgs{Rank: -1}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 5, val)
+	}
+	_, err := cli.LPos(ctx, key, "b", client.LPosArgs{MaxLen: 2}).Result()
+	assert.ErrorIs(t, err, client.Nil)
+	if val, err := cli.LPosCount(ctx, key, "b", 0, client.LPosArgs{}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []int{2, 5}, val)
+	}
+
+	if val, err := cli.LRem(ctx, key, -1, "b").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.LRem(ctx, key, 0, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.LRange(ctx, key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"x", "b", "c", "e"}, val)
+	}
+}
+
+func TestLMove(t *testing.T) {
+	ctx := context.Background()
+	src, dst := uuid.NewString(), uuid.NewString()
+	assert.NoError(t, cli.RPush(ctx, src, "a", "b", "c").Err())
+
+	if val, err := cli.RPopLPush(ctx, src, dst).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "c", val)
+	}
+	if val, err := cli.LMove(ctx, src, dst, "LEFT", "RIGHT").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "a", val)
+	}
+	if val, err := cli.LRange(ctx, dst, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"c", "a"}, val)
+	}
+
+	// rotating a list onto itself
+	if val, err := cli.LMove(ctx, dst, dst, "LEFT", "RIGHT").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "c", val)
+	}
+	if val, err := cli.LRange(ctx, dst, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"a", "c"}, val)
+	}
+
+	// the source is left alone when the destination is not a list
+	set := uuid.NewString()
+	assert.NoError(t, cli.SAdd(ctx, set, "m").Err())
+	assert.Error(t, cli.LMove(ctx, src, set, "LEFT", "LEFT").Err())
+	if val, err := cli.LRange(ctx, src, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"b"}, val)
+	}
+
+	// moving the last element deletes the source
+	assert.NoError(t, cli.LMove(ctx, src, dst, "RIGHT", "LEFT").Err())
+	if val, err := cli.Exists(ctx, src).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.False(t, val)
+	}
+	if val, err := cli.LMove(ctx, src, dst, "LEFT", "LEFT").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "", val)
+	}
+	assert.Error(t, cli.LMove(ctx, src, dst, "UP", "LEFT").Err())
+}
+
+func TestLMoveConcurrent(t *testing.T) {
+	ctx := context.Background()
+	a, b := uuid.NewString(), uuid.NewString()
+	const elements, clients, moves = 50, 8, 200
+	for i := 0; i < elements; i++ {
+		assert.NoError(t, cli.RPush(ctx, a, strconv.Itoa(i)).Err())
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := client.NewClient(serverAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() { _ = c.Close() }()
+			src, dst := a, b
+			if i%2 == 0 {
+				src, dst = b, a
+			}
+			for j := 0; j < moves; j++ {
+				assert.NoError(t, c.LMove(ctx, src, dst, "LEFT", "RIGHT").Err())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// no element is lost or duplicated between the two lists
+	var all []string
+	for _, key := range []string{a, b} {
+		values, err := cli.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, values...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		x, _ := strconv.Atoi(all[i])
+		y, _ := strconv.Atoi(all[j])
+		return x < y
+	})
+	expected := make([]string, 0, elements)
+	for i := 0; i < elements; i++ {
+		expected = append(expected, strconv.Itoa(i))
+	}
+	assert.Equal(t, expected, all)
+}
+
+func TestBlockingPop(t *testing.T) {
+	ctx := context.Background()
+	newClient := func() *client.Client {
+		c, err := client.NewClient(serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		empty, key := uuid.NewString(), uuid.NewString()
+		assert.NoError(t, cli.RPush(ctx, key, "a", "b").Err())
+		if val, err := cli.BLPop(ctx, time.Second, empty, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{key, "a"}, val)
+		}
+		if val, err := cli.BRPop(ctx, time.Second, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{key, "b"}, val)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := cli.BLPop(ctx, 100*time.Millisecond, uuid.NewString()).Result()
+		assert.ErrorIs(t, err, client.Nil)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		// the connection is still usable
+		assert.NoError(t, cli.Ping(ctx).Err())
+	})
+
+	t.Run("wake up", func(t *testing.T) {
+		a, b := uuid.NewString(), uuid.NewString()
+		c := newClient()
+		result := make(chan []string, 1)
+		go func() {
+			val, err := c.BRPop(ctx, 5*time.Second, a, b).Result()
+			assert.NoError(t, err)
+			result <- val
+		}()
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, cli.RPush(ctx, b, "x", "y").Err())
+		assert.Equal(t, []string{b, "y"}, <-result)
+	})
+
+	t.Run("fifo", func(t *testing.T) {
+		key := uuid.NewString()
+		const waiters = 3
+		results := make([]chan string, waiters)
+		for i := range results {
+			results[i] = make(chan string, 1)
+			c := newClient()
+			go func(i int) {
+				val, err := c.BLPop(ctx, 5*time.Second, key).Result()
+				assert.NoError(t, err)
+				if len(val) == 2 {
+					results[i] <- val[1]
+				} else {
+					results[i] <- ""
+				}
+			}(i)
+			// the waiters block in order
+			time.Sleep(50 * time.Millisecond)
+		}
+		assert.NoError(t, cli.RPush(ctx, key, "0", "1", "2").Err())
+		for i, ch := range results {
+			assert.Equal(t, strconv.Itoa(i), <-ch)
+		}
+	})
+
+	t.Run("blmove", func(t *testing.T) {
+		src, dst := uuid.NewString(), uuid.NewString()
+		c := newClient()
+		result := make(chan string, 1)
+		go func() {
+			val, err := c.BLMove(ctx, src, dst, "RIGHT", "LEFT", 5*time.Second).Result()
+			assert.NoError(t, err)
+			result <- val
+		}()
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, cli.RPush(ctx, src, "a", "b").Err())
+		assert.Equal(t, "b", <-result)
+		if val, err := cli.LRange(ctx, dst, 0, -1).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{"b"}, val)
+		}
+		assert.Error(t, cli.BLMove(ctx, src, dst, "UP", "LEFT", time.Second).Err())
+		// a timeout is not an empty element
+		assert.ErrorIs(t, cli.BLMove(ctx, uuid.NewString(), dst, "LEFT", "LEFT", 50*time.Millisecond).Err(), client.Nil)
+		empty := uuid.NewString()
+		assert.NoError(t, cli.RPush(ctx, empty, "").Err())
+		if val, err := cli.BLMove(ctx, empty, dst, "LEFT", "LEFT", time.Second).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "", val)
+		}
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		// the server drops the waiter of a closed connection, the next push is
+		// not handed to it
+		for _, resp := range []bool{false, true} {
+			key := uuid.NewString()
+			if resp {
+				conn, err := net.Dial("tcp", serverAddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = conn.Write([]byte(respCommand("BLPOP", key, "0")))
+				assert.NoError(t, err)
+				time.Sleep(50 * time.Millisecond)
+				_ = conn.Close()
+			} else {
+				cancelCtx, cancel := context.WithCancel(ctx)
+				time.AfterFunc(50*time.Millisecond, cancel)
+				assert.ErrorIs(t, newClient().BLPop(cancelCtx, 0, key).Err(), context.Canceled)
+			}
+			time.Sleep(100 * time.Millisecond)
+			assert.NoError(t, cli.RPush(ctx, key, "job1").Err())
+			if val, err := cli.LLen(ctx, key).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, 1, val)
+			}
+		}
+	})
+
+	t.Run("pipelined", func(t *testing.T) {
+		// a command sent while blocked is served after the pop
+		key := uuid.NewString()
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+		_, err = conn.Write([]byte(respCommand("BLPOP", key, "5")))
+		assert.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		_, err = conn.Write([]byte(respCommand("PING")))
+		assert.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, cli.RPush(ctx, key, "job").Err())
+		var sb strings.Builder
+		for i := 0; i < 6; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			sb.WriteString(line)
+		}
+		assert.Equal(t, "*2\r\n$36\r\n"+key+"\r\n$3\r\njob\r\n+pong\r\n", sb.String())
+	})
+
+	t.Run("context", func(t *testing.T) {
+		c := newClient()
+		deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := c.BLPop(deadlineCtx, 0, uuid.NewString()).Result()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 2*time.Second)
+
+		cancelCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, err = c.BLPop(cancelCtx, 0, uuid.NewString()).Result()
+		assert.ErrorIs(t, err, context.Canceled)
+		// a done context fails without sending the command
+		assert.ErrorIs(t, c.Ping(cancelCtx).Err(), context.Canceled)
+		assert.NoError(t, c.Ping(ctx).Err())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Error(t, cli.BLPop(ctx, -time.Second, "key").Err())
+		assert.Error(t, cli.BLPop(ctx, time.Second).Err())
+	})
 }
 
 func TestCmdable_SAdd(t *testing.T) {
@@ -404,10 +922,9 @@ func TestCmdable_SAdd(t *testing.T) {
 
 		assert.NoError(t, cli.SAdd(context.Background(), t.Name(), "val2").Err())
 
-		if val, err := cli.SMembers(context.Background(), t.Name()).Result(); err != nil {
+		if val, err := cli.SMembersSorted(context.Background(), t.Name()).Result(); err != nil {
 			t.Fatal(err)
 		} else {
-			sort.Strings(val)
 			assert.Equal(t, []string{"val", "val2"}, val)
 		}
 
@@ -430,3 +947,1610 @@ func TestCmdable_SAdd(t *testing.T) {
 		}
 	})
 }
+
+func TestSetCommands(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+	assert.NoError(t, cli.SAdd(ctx, key, "a", "b", "c", "d", "e").Err())
+
+	if val, err := cli.SRem(ctx, key, "a", "missing").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.SCard(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 4, val)
+	}
+
+	if val, err := cli.SRandMember(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Contains(t, []string{"b", "c", "d", "e"}, val)
+	}
+	if val, err := cli.SRandMemberN(ctx, key, 10).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		sort.Strings(val)
+		assert.Equal(t, []string{"b", "c", "d", "e"}, val)
+	}
+	if val, err := cli.SRandMemberN(ctx, key, -10).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Len(t, val, 10)
+	}
+	// counts whose negation overflows are rejected
+	for _, count := range []int{math.MinInt, math.MinInt / 2} {
+		assert.Error(t, cli.SRandMemberN(ctx, key, count).Err())
+	}
+	assert.NoError(t, cli.Ping(ctx).Err())
+	if val, err := cli.SRandMemberN(ctx, key, -100_000).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Len(t, val, 100_000)
+	}
+
+	popped, err := cli.SPopN(ctx, key, 3).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, popped, 3)
+	last, err := cli.SPop(ctx, key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"b", "c", "d", "e"}, append(popped, last))
+	// popping the last member deletes the set
+	if val, err := cli.Exists(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.False(t, val)
+	}
+	if val, err := cli.SPopN(ctx, key, 2).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Empty(t, val)
+	}
+	if val, err := cli.SRandMemberN(ctx, key, 2).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Empty(t, val)
+	}
+}
+
+func TestSMove(t *testing.T) {
+	ctx := context.Background()
+	src, dst := uuid.NewString(), uuid.NewString()
+	assert.NoError(t, cli.SAdd(ctx, src, "a", "b").Err())
+
+	if val, err := cli.SMove(ctx, src, dst, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.True(t, val)
+	}
+	if val, err := cli.SMove(ctx, src, dst, "missing").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.False(t, val)
+	}
+	if val, err := cli.SMove(ctx, dst, dst, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.True(t, val)
+	}
+	if val, err := cli.SMembers(ctx, dst).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"a"}, val)
+	}
+
+	// the source is left alone when the destination is not a set
+	list := uuid.NewString()
+	assert.NoError(t, cli.RPush(ctx, list, "x").Err())
+	assert.Error(t, cli.SMove(ctx, src, list, "b").Err())
+	if val, err := cli.SMembers(ctx, src).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"b"}, val)
+	}
+
+	// moving the last member deletes the source
+	assert.NoError(t, cli.SMove(ctx, src, dst, "b").Err())
+	if val, err := cli.Exists(ctx, src).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.False(t, val)
+	}
+	if val, err := cli.SCard(ctx, dst).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2, val)
+	}
+}
+
+func TestSScan(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+	members := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		members = append(members, fmt.Sprintf("member:%03d", i))
+	}
+	assert.NoError(t, cli.SAdd(ctx, key, members...).Err())
+
+	if val, err := cli.SMembersSorted(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, members, val)
+	}
+
+	t.Run("walk", func(t *testing.T) {
+		seen := map[string]int{}
+		var cursor uint64
+		pages := 0
+		for {
+			page, next, err := cli.SScan(ctx, key, cursor, "", 7).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.LessOrEqual(t, len(page), 8)
+			for _, m := range page {
+				seen[m]++
+			}
+			pages++
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		assert.Len(t, seen, len(members))
+		for m, n := range seen {
+			assert.Equal(t, 1, n, m)
+		}
+		assert.GreaterOrEqual(t, pages, len(members)/7)
+	})
+
+	t.Run("match", func(t *testing.T) {
+		var matched []string
+		var cursor uint64
+		for {
+			page, next, err := cli.SScan(ctx, key, cursor, "member:0[0-1]?", 0).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched = append(matched, page...)
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		assert.ElementsMatch(t, members[:20], matched)
+	})
+
+	t.Run("match patterns", func(t *testing.T) {
+		key := uuid.NewString()
+		long := strings.Repeat("a", 64)
+		assert.NoError(t, cli.SAdd(ctx, key, "hello", "hallo", "hxllo", "hllo", "heeeello", "h*llo", "[x]", long).Err())
+		for pattern, want := range map[string][]string{
+			"h?llo":     {"hello", "hallo", "hxllo", "h*llo"},
+			"h*llo":     {"hello", "hallo", "hxllo", "hllo", "heeeello", "h*llo"},
+			"h[ae]llo":  {"hello", "hallo"},
+			"h[^e]llo":  {"hallo", "hxllo", "h*llo"},
+			"h[a-b]llo": {"hallo"},
+			"h\\*llo":   {"h*llo"},
+			"\\[x\\]":   {"[x]"},
+			"*e*e*o":    {"heeeello"},
+			"**":        {"hello", "hallo", "hxllo", "hllo", "heeeello", "h*llo", "[x]", long},
+			"nope*":     {},
+			// backtracking to every star would take exponential time
+			strings.Repeat("*a", 32) + "*b": {},
+		} {
+			page, _, err := cli.SScan(ctx, key, 0, pattern, 100).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, want, page, pattern)
+		}
+	})
+
+	t.Run("changes while walking", func(t *testing.T) {
+		// members removed and added meanwhile may or may not be returned, the
+		// others are returned once
+		key := uuid.NewString()
+		assert.NoError(t, cli.SAdd(ctx, key, members...).Err())
+		seen := map[string]int{}
+		var cursor uint64
+		for i := 0; ; i++ {
+			page, next, err := cli.SScan(ctx, key, cursor, "", 10).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range page {
+				seen[m]++
+			}
+			assert.NoError(t, cli.SRem(ctx, key, members[i]).Err())
+			assert.NoError(t, cli.SAdd(ctx, key, fmt.Sprintf("new:%d", i)).Err())
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		for m, n := range seen {
+			assert.Equal(t, 1, n, m)
+		}
+		for _, m := range members[20:] {
+			assert.Equal(t, 1, seen[m], m)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		page, cursor, err := cli.SScan(ctx, uuid.NewString(), 0, "", 0).Result()
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+		assert.Equal(t, uint64(0), cursor)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Error(t, cli.SScan(ctx, key, 0, "", -1).Err())
+	})
+}
+
+func TestSetAlgebra(t *testing.T) {
+	ctx := context.Background()
+	a, b, c, missing := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	assert.NoError(t, cli.SAdd(ctx, a, "1", "2", "3", "4").Err())
+	assert.NoError(t, cli.SAdd(ctx, b, "2", "3", "5").Err())
+	assert.NoError(t, cli.SAdd(ctx, c, "3", "6").Err())
+
+	for _, tc := range []struct {
+		name     string
+		cmd      *client.StringSliceCmd
+		expected []string
+	}{
+		{"inter", cli.SInter(ctx, a, b), []string{"2", "3"}},
+		{"inter three", cli.SInter(ctx, a, b, c), []string{"3"}},
+		{"inter missing", cli.SInter(ctx, a, missing), []string{}},
+		{"union", cli.SUnion(ctx, a, b, c, missing), []string{"1", "2", "3", "4", "5", "6"}},
+		{"diff", cli.SDiff(ctx, a, b, missing), []string{"1", "4"}},
+		{"diff missing first", cli.SDiff(ctx, missing, a), []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if val, err := tc.cmd.Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				sort.Strings(val)
+				assert.Equal(t, tc.expected, val)
+			}
+		})
+	}
+
+	t.Run("store", func(t *testing.T) {
+		dst := uuid.NewString()
+		if val, err := cli.SUnionStore(ctx, dst, a, c).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 5, val)
+		}
+		// the destination may be one of the sources
+		if val, err := cli.SInterStore(ctx, dst, dst, b).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 2, val)
+		}
+		if val, err := cli.SMembers(ctx, dst).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			sort.Strings(val)
+			assert.Equal(t, []string{"2", "3"}, val)
+		}
+		// the destination is replaced whatever its type, an empty result deletes it
+		assert.NoError(t, cli.Set(ctx, dst, "string").Err())
+		if val, err := cli.SDiffStore(ctx, dst, c, a).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 1, val)
+		}
+		if val, err := cli.SDiffStore(ctx, dst, a, a).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 0, val)
+		}
+		if val, err := cli.Exists(ctx, dst).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.False(t, val)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		list := uuid.NewString()
+		assert.NoError(t, cli.RPush(ctx, list, "1").Err())
+		assert.Error(t, cli.SUnion(ctx, a, list).Err())
+		assert.Error(t, cli.SInterStore(ctx, uuid.NewString(), a, list).Err())
+	})
+}
+
+// TestSetAlgebraConsistent moves members between two sets while their union
+// is computed, the union locks both sets so it never misses a member.
+func TestSetAlgebraConsistent(t *testing.T) {
+	ctx := context.Background()
+	a, b := uuid.NewString(), uuid.NewString()
+	members := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		members = append(members, strconv.Itoa(i))
+	}
+	assert.NoError(t, cli.SAdd(ctx, a, members...).Err())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := client.NewClient(serverAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = c.Close() }()
+		for i := 0; i < 500; i++ {
+			m := members[i%len(members)]
+			src, dst := a, b
+			if (i/len(members))%2 == 1 {
+				src, dst = b, a
+			}
+			assert.NoError(t, c.SMove(ctx, src, dst, m).Err())
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if val, err := cli.SUnion(ctx, a, b).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Len(t, val, len(members))
+		}
+	}
+	<-done
+}
+
+func TestSPopReplay(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63998"
+	srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+		options.AOFSync = kvstore.AOFSyncAlways
+	})
+	c := srv.start()
+	members := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		members = append(members, strconv.Itoa(i))
+	}
+	assert.NoError(t, c.SAdd(ctx, "set", members...).Err())
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.SPopN(ctx, "set", 5).Err())
+	}
+	remaining, err := c.SMembers(ctx, "set").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.stop()
+
+	// the AOF replays the same pops
+	c = srv.start()
+	if val, err := c.SMembers(ctx, "set").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Len(t, val, 50)
+		assert.ElementsMatch(t, remaining, val)
+	}
+}
+
+func TestAOFCanonicalRecords(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63999"
+	srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+		options.AOFSync = kvstore.AOFSyncAlways
+	})
+	srv.start()
+	// a line ended by a bare newline instead of the line suffix
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("set  key   val\n"))
+	assert.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "OK"+kvstore.LineSuffix, reply)
+	_ = conn.Close()
+	srv.stop()
+
+	c := srv.start()
+	if val, err := c.Get(ctx, "key").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "val", val)
+	}
+}
+
+func TestBinarySafeArgs(t *testing.T) {
+	values := map[string]string{
+		"spaces":   "hello  world",
+		"quotes":   `say "hi" it's`,
+		"newlines": "line1\nline2\r\n",
+		"tabs":     "a\tb",
+		"binary":   "\x00bin\xff\x7f",
+		"empty":    "",
+		"escapes":  `c:\path\x41`,
+		// the line suffix and the error prefix of the line protocol
+		"suffix": "x\t\ny",
+		"error":  "Error: not an error",
+	}
+	for name, val := range values {
+		t.Run(name, func(t *testing.T) {
+			key := "binary key " + name
+			assert.NoError(t, cli.Set(context.Background(), key, val).Err())
+
+			if got, err := cli.Get(context.Background(), key).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, val, got)
+			}
+			// the connection is still in sync
+			assert.NoError(t, cli.Ping(context.Background()).Err())
+		})
+	}
+}
+
+func TestFramedArrayReply(t *testing.T) {
+	key := uuid.NewString()
+	if val, err := cli.LRange(context.Background(), key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{}, val)
+	}
+
+	assert.NoError(t, cli.RPush(context.Background(), key, "").Err())
+	if val, err := cli.LRange(context.Background(), key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{""}, val)
+	}
+
+	assert.NoError(t, cli.RPush(context.Background(), key, "a,b", "c\t\nd").Err())
+	if val, err := cli.LPop(context.Background(), key, 3).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"", "a,b", "c\t\nd"}, val)
+	}
+}
+
+func TestLargeReply(t *testing.T) {
+	key := uuid.NewString()
+	var values []string
+	for i := 0; i < 500; i++ {
+		values = append(values, fmt.Sprintf("value-%d-%s", i, uuid.NewString()))
+	}
+	assert.NoError(t, cli.RPush(context.Background(), key, values...).Err())
+
+	if val, err := cli.LRange(context.Background(), key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, values, val)
+	}
+
+	t.Run("max reply size", func(t *testing.T) {
+		small, err := client.NewClientWithOptions(serverAddr, &client.Options{MaxReplySize: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = small.Close() }()
+
+		_, err = small.LRange(context.Background(), key, 0, -1).Result()
+		assert.ErrorIs(t, err, client.ErrReplyTooLarge)
+
+		// the next command runs on a fresh connection
+		if val, err := small.LLen(context.Background(), key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 500, val)
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("set with expiration", func(t *testing.T) {
+		key := uuid.NewString()
+		assert.NoError(t, cli.SetEX(ctx, key, "val", 100*time.Millisecond).Err())
+
+		if val, err := cli.PTTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.True(t, val > 0 && val <= 100*time.Millisecond, val)
+		}
+		if val, err := cli.Get(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "val", val)
+		}
+
+		time.Sleep(150 * time.Millisecond)
+		if val, err := cli.Exists(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, false, val)
+		}
+		if val, err := cli.TTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, time.Duration(-2), val)
+		}
+	})
+
+	t.Run("expire and persist", func(t *testing.T) {
+		key := uuid.NewString()
+		if val, err := cli.Expire(ctx, key, 10*time.Second).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, false, val)
+		}
+
+		assert.NoError(t, cli.Set(ctx, key, "val").Err())
+		if val, err := cli.TTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, time.Duration(-1), val)
+		}
+		if val, err := cli.Expire(ctx, key, 10*time.Second).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, true, val)
+		}
+		if val, err := cli.TTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 10*time.Second, val)
+		}
+		if val, err := cli.Persist(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, true, val)
+		}
+		if val, err := cli.TTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, time.Duration(-1), val)
+		}
+	})
+
+	t.Run("multi-key set with keys named like options", func(t *testing.T) {
+		key := uuid.NewString()
+		assert.NoError(t, cli.Set(ctx, key, "val", "px", "val").Err())
+		assert.NoError(t, cli.Set(ctx, key, "val", "ex", "10", "px", "20").Err())
+		for k, want := range map[string]string{key: "val", "ex": "10", "px": "20"} {
+			if val, err := cli.Get(ctx, k).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, want, val, k)
+			}
+		}
+		if val, err := cli.TTL(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, time.Duration(-1), val)
+		}
+	})
+
+	t.Run("expire list", func(t *testing.T) {
+		key := uuid.NewString()
+		assert.NoError(t, cli.RPush(ctx, key, "a", "b").Err())
+		assert.NoError(t, cli.PExpire(ctx, key, 50*time.Millisecond).Err())
+
+		time.Sleep(100 * time.Millisecond)
+		if val, err := cli.LLen(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 0, val)
+		}
+	})
+}
+
+func TestExpirePersistence(t *testing.T) {
+	ctx := context.Background()
+	for i, backupType := range []kvstore.BackupType{kvstore.BackupAOF, kvstore.BackupRDB} {
+		t.Run(string(backupType), func(t *testing.T) {
+			addr := fmt.Sprintf("localhost:%d", 63920+i)
+			srv := newBackupServer(t, addr, backupType, nil)
+			c := srv.start()
+			assert.NoError(t, c.SetEX(ctx, "session", "val", time.Hour).Err())
+			assert.NoError(t, c.SetEX(ctx, "short", "val", 50*time.Millisecond).Err())
+			if backupType == kvstore.BackupRDB {
+				assert.NoError(t, srv.WriteBackup())
+			}
+			srv.stop()
+
+			time.Sleep(100 * time.Millisecond)
+			c = srv.start()
+			if val, err := c.TTL(ctx, "session").Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.InDelta(t, time.Hour, val, float64(time.Second))
+			}
+			if val, err := c.Exists(ctx, "short").Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, false, val)
+			}
+		})
+	}
+}
+
+func TestExpireReplay(t *testing.T) {
+	ctx := context.Background()
+	srv := newBackupServer(t, "localhost:64100", kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+		options.AOFSync = kvstore.AOFSyncAlways
+	})
+	c := srv.start()
+	// the list expires after its last push
+	assert.NoError(t, c.RPush(ctx, "expired", "a").Err())
+	assert.NoError(t, c.PExpire(ctx, "expired", 100*time.Millisecond).Err())
+	assert.NoError(t, c.RPush(ctx, "expired", "b").Err())
+	// the list expires before its last push, which creates a new one
+	assert.NoError(t, c.RPush(ctx, "recreated", "a").Err())
+	assert.NoError(t, c.PExpire(ctx, "recreated", 100*time.Millisecond).Err())
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, c.RPush(ctx, "recreated", "b").Err())
+	// a deadline in the past is replayed as well
+	assert.NoError(t, c.RPush(ctx, "past", "a").Err())
+	assert.NoError(t, c.PExpireAt(ctx, "past", time.Now().Add(-time.Second)).Err())
+	assert.NoError(t, c.RPush(ctx, "past", "b").Err())
+	srv.stop()
+
+	// the replay runs after every deadline passed
+	time.Sleep(200 * time.Millisecond)
+	c = srv.start()
+	for key, want := range map[string][]string{"expired": {}, "recreated": {"b"}, "past": {"b"}} {
+		if val, err := c.LRange(ctx, key, 0, -1).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, want, val, key)
+		}
+	}
+	if val, err := c.PTTL(ctx, "recreated").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, time.Duration(-1), val)
+	}
+}
+
+func TestHash(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+
+	if val, err := cli.HSet(ctx, key, "name", "kv", "count", "1").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2, val)
+	}
+	if val, err := cli.HSet(ctx, key, "name", "kvstore", "lang", "go").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.HGet(ctx, key, "name").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "kvstore", val)
+	}
+	if val, err := cli.HIncrBy(ctx, key, "count", 41).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 42, val)
+	}
+	assert.Error(t, cli.HIncrBy(ctx, key, "name", 1).Err())
+
+	if val, err := cli.HGetAll(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, map[string]string{"name": "kvstore", "count": "42", "lang": "go"}, val)
+	}
+	if val, err := cli.HKeys(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"count", "lang", "name"}, val)
+	}
+	if val, err := cli.HDel(ctx, key, "lang", "missing").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.HLen(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2, val)
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		missing := uuid.NewString()
+		if val, err := cli.HGetAll(ctx, missing).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, map[string]string{}, val)
+		}
+		if val, err := cli.Exists(ctx, missing).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, false, val)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		str := uuid.NewString()
+		assert.NoError(t, cli.Set(ctx, str, "val").Err())
+		assert.Error(t, cli.HGet(ctx, str, "field").Err())
+	})
+}
+
+func TestHashPersistence(t *testing.T) {
+	ctx := context.Background()
+	for i, backupType := range []kvstore.BackupType{kvstore.BackupAOF, kvstore.BackupRDB} {
+		t.Run(string(backupType), func(t *testing.T) {
+			addr := fmt.Sprintf("localhost:%d", 63930+i)
+			srv := newBackupServer(t, addr, backupType, nil)
+			c := srv.start()
+			assert.NoError(t, c.HSet(ctx, "hash", "a", "1", "b", "2").Err())
+			assert.NoError(t, c.HIncrBy(ctx, "hash", "a", 1).Err())
+			if backupType == kvstore.BackupRDB {
+				assert.NoError(t, srv.WriteBackup())
+			}
+			srv.stop()
+
+			c = srv.start()
+			if val, err := c.HGetAll(ctx, "hash").Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, map[string]string{"a": "2", "b": "2"}, val)
+			}
+			assert.NoError(t, c.HSet(ctx, "hash", "c", "3").Err())
+		})
+	}
+}
+
+func TestZSet(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+
+	if val, err := cli.ZAdd(ctx, key, client.Z{Score: 1, Member: "a"}, client.Z{Score: 2, Member: "b"}, client.Z{Score: 3, Member: "c"}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 3, val)
+	}
+	if val, err := cli.ZAdd(ctx, key, client.Z{Score: 2.5, Member: "a"}, client.Z{Score: math.Inf(1), Member: "d"}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.ZRange(ctx, key, 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"b", "a", "c", "d"}, val)
+	}
+	if val, err := cli.ZRevRangeWithScores(ctx, key, 0, 1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []client.Z{{Score: math.Inf(1), Member: "d"}, {Score: 3, Member: "c"}}, val)
+	}
+	if val, err := cli.ZScore(ctx, key, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2.5, val)
+	}
+	if val, err := cli.ZRank(ctx, key, "c").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 2, val)
+	}
+	if val, err := cli.ZRevRank(ctx, key, "c").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.ZIncrBy(ctx, key, -2, "c").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1.0, val)
+	}
+	if val, err := cli.ZRangeByScoreWithScores(ctx, key, &client.ZRangeBy{Min: "(1", Max: "+inf"}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []client.Z{{Score: 2, Member: "b"}, {Score: 2.5, Member: "a"}, {Score: math.Inf(1), Member: "d"}}, val)
+	}
+	if val, err := cli.ZRangeByScore(ctx, key, &client.ZRangeBy{Min: "-inf", Max: "3", Offset: 1, Count: 2}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"b", "a"}, val)
+	}
+	// like redis a negative offset returns no member
+	if val, err := cli.ZRangeByScore(ctx, key, &client.ZRangeBy{Min: "-inf", Max: "+inf", Offset: -1, Count: 2}).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Empty(t, val)
+	}
+	if val, err := cli.ZRem(ctx, key, "d", "missing").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 1, val)
+	}
+	if val, err := cli.ZCard(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 3, val)
+	}
+
+	t.Run("missing member", func(t *testing.T) {
+		assert.ErrorIs(t, cli.ZScore(ctx, key, "missing").Err(), client.Nil)
+		assert.ErrorIs(t, cli.ZRank(ctx, key, "missing").Err(), client.Nil)
+		// the connection is still usable after a nil reply
+		assert.NoError(t, cli.Ping(ctx).Err())
+	})
+
+	t.Run("empty set is deleted", func(t *testing.T) {
+		assert.NoError(t, cli.ZRem(ctx, key, "a", "b", "c").Err())
+		if val, err := cli.Exists(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, false, val)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		str := uuid.NewString()
+		assert.NoError(t, cli.Set(ctx, str, "val").Err())
+		assert.Error(t, cli.ZAdd(ctx, str, client.Z{Score: 1, Member: "a"}).Err())
+		assert.Error(t, cli.ZAdd(ctx, key, client.Z{Score: math.NaN(), Member: "a"}).Err())
+	})
+}
+
+func TestZSetPersistence(t *testing.T) {
+	ctx := context.Background()
+	for i, backupType := range []kvstore.BackupType{kvstore.BackupAOF, kvstore.BackupRDB} {
+		t.Run(string(backupType), func(t *testing.T) {
+			addr := fmt.Sprintf("localhost:%d", 63940+i)
+			srv := newBackupServer(t, addr, backupType, nil)
+			c := srv.start()
+			assert.NoError(t, c.ZAdd(ctx, "zset", client.Z{Score: 1, Member: "a"}, client.Z{Score: math.Inf(-1), Member: "b"}).Err())
+			assert.NoError(t, c.ZIncrBy(ctx, "zset", 1.5, "a").Err())
+			if backupType == kvstore.BackupRDB {
+				assert.NoError(t, srv.WriteBackup())
+			}
+			srv.stop()
+
+			c = srv.start()
+			if val, err := c.ZRangeWithScores(ctx, "zset", 0, -1).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, []client.Z{{Score: math.Inf(-1), Member: "b"}, {Score: 2.5, Member: "a"}}, val)
+			}
+			assert.NoError(t, c.ZAdd(ctx, "zset", client.Z{Score: 3, Member: "c"}).Err())
+		})
+	}
+}
+
+func TestRDBTypes(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63950"
+	srv := newBackupServer(t, addr, kvstore.BackupRDB, nil)
+	c := srv.start()
+	assert.NoError(t, c.Set(ctx, "string", "a\x00b").Err())
+	assert.NoError(t, c.RPush(ctx, "list", "a", "b,c").Err())
+	assert.NoError(t, c.SAdd(ctx, "set", "a", "b").Err())
+	assert.NoError(t, c.Expire(ctx, "set", time.Hour).Err())
+	assert.NoError(t, srv.WriteBackup())
+	srv.stop()
+
+	c = srv.start()
+	if val, err := c.Get(ctx, "string").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "a\x00b", val)
+	}
+	// restored values keep their type and accept further writes
+	assert.NoError(t, c.LPush(ctx, "list", "z").Err())
+	if val, err := c.LRange(ctx, "list", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"z", "a", "b,c"}, val)
+	}
+	assert.NoError(t, c.SAdd(ctx, "set", "c").Err())
+	if val, err := c.SMembers(ctx, "set").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		sort.Strings(val)
+		assert.Equal(t, []string{"a", "b", "c"}, val)
+	}
+	if val, err := c.TTL(ctx, "set").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.InDelta(t, time.Hour, val, float64(time.Second))
+	}
+}
+
+func TestRDBLegacyJSON(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63951"
+	path := t.TempDir()
+	legacy := `{"string":"val","list":{"Values":["a","b"]},"set":{"Map":{"a":true},"RWMutex":{}}}`
+	if err := os.WriteFile(filepath.Join(path, "backup-rdb.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(t, addr, &kvstore.ServerOptions{Backup: true, BackupType: kvstore.BackupRDB, BackupPath: path})
+	c, err := client.NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get(ctx, "string").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "val", val)
+	}
+	assert.NoError(t, c.RPush(ctx, "list", "c").Err())
+	if val, err := c.LRange(ctx, "list", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"a", "b", "c"}, val)
+	}
+	if val, err := c.SIsMember(ctx, "set", "a").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, true, val)
+	}
+}
+
+func TestRDBSnapshots(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63952"
+	srv := newBackupServer(t, addr, kvstore.BackupRDB, func(options *kvstore.ServerOptions) {
+		options.BackupRetain = 2
+	})
+	c := srv.start()
+	for _, val := range []string{"1", "2"} {
+		assert.NoError(t, c.Set(ctx, "key", val).Err())
+		assert.NoError(t, srv.WriteBackup())
+	}
+	// the last snapshot is written on shutdown
+	assert.NoError(t, c.Set(ctx, "key", "3").Err())
+	srv.stop()
+
+	snapshots, err := filepath.Glob(filepath.Join(srv.path, "backup-*.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(snapshots)
+	assert.Equal(t, []string{filepath.Join(srv.path, "backup-2.rdb"), filepath.Join(srv.path, "backup-3.rdb")}, snapshots)
+
+	// corrupt the newest snapshot, the previous one is loaded instead
+	b, err := os.ReadFile(snapshots[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(snapshots[1], b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = srv.start()
+	if val, err := c.Get(ctx, "key").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "2", val)
+	}
+}
+
+func TestRDBConsistentSnapshot(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63953"
+	srv := newBackupServer(t, addr, kvstore.BackupRDB, nil)
+	c := srv.start()
+	// a is always set before b, so any point in time has b == a or b == a-1
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			val := strconv.Itoa(i)
+			if err := c.Set(ctx, "a", val).Err(); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := c.Set(ctx, "b", val).Err(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, srv.WriteBackup())
+	}
+	<-done
+	srv.stop()
+
+	c = srv.start()
+	a, err := c.Get(ctx, "a").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Get(ctx, "b").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai, _ := strconv.Atoi(a)
+	bi, _ := strconv.Atoi(b)
+	assert.Contains(t, []int{ai, ai - 1}, bi, "a=%s b=%s", a, b)
+}
+
+func TestAOFSync(t *testing.T) {
+	ctx := context.Background()
+	for i, policy := range []kvstore.AOFSyncPolicy{kvstore.AOFSyncAlways, kvstore.AOFSyncEverySec, kvstore.AOFSyncNo} {
+		t.Run(string(policy), func(t *testing.T) {
+			addr := fmt.Sprintf("localhost:%d", 63960+i)
+			srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+				options.AOFSync = policy
+			})
+			srv.start()
+			// concurrent clients share the fsyncs of the always policy
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					c, err := client.NewClient(addr)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer func() { _ = c.Close() }()
+					for j := 0; j < 50; j++ {
+						if err := c.Set(ctx, fmt.Sprintf("key-%d-%d", w, j), "val").Err(); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			srv.stop()
+
+			c := srv.start()
+			if val, err := c.Keys(ctx).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Len(t, val, 400)
+			}
+		})
+	}
+}
+
+// waitAOFSize waits until the AOF in path satisfies ok.
+func waitAOFSize(t *testing.T, path string, ok func(size int64) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := os.Stat(filepath.Join(path, "backup-aof.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok(info.Size()) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("aof size %d did not reach the expected size", info.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("manual", func(t *testing.T) {
+		addr := "localhost:63970"
+		srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+			options.AOFRewritePercentage = -1
+		})
+		c := srv.start()
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, c.Set(ctx, "counter", strconv.Itoa(i)).Err())
+			assert.NoError(t, c.RPush(ctx, "list", strconv.Itoa(i)).Err())
+		}
+		assert.NoError(t, c.ZAdd(ctx, "zset", client.Z{Score: math.Inf(1), Member: "a"}).Err())
+		assert.NoError(t, c.SetEX(ctx, "session", "val", time.Hour).Err())
+		info, err := os.Stat(filepath.Join(srv.path, "backup-aof.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, c.BgRewriteAOF(ctx).Err())
+		// writes made during the rewrite are kept
+		assert.NoError(t, c.Set(ctx, "during", "val").Err())
+		waitAOFSize(t, srv.path, func(size int64) bool { return size < info.Size()/2 })
+		assert.NoError(t, c.Set(ctx, "after", "val").Err())
+		srv.stop()
+
+		c = srv.start()
+		if val, err := c.Get(ctx, "counter").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "199", val)
+		}
+		if val, err := c.LLen(ctx, "list").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 200, val)
+		}
+		if val, err := c.ZScore(ctx, "zset", "a").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, math.Inf(1), val)
+		}
+		if val, err := c.TTL(ctx, "session").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.InDelta(t, time.Hour, val, float64(time.Second))
+		}
+		for _, key := range []string{"during", "after"} {
+			if val, err := c.Get(ctx, key).Result(); err != nil {
+				t.Fatal(err)
+			} else {
+				assert.Equal(t, "val", val)
+			}
+		}
+	})
+
+	t.Run("automatic", func(t *testing.T) {
+		addr := "localhost:63971"
+		path := t.TempDir()
+		startTestServer(t, addr, &kvstore.ServerOptions{
+			Backup: true, BackupType: kvstore.BackupAOF, BackupPath: path,
+			AOFRewritePercentage: 100, AOFRewriteMinSize: 1024,
+		})
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, c.Set(ctx, "counter", strconv.Itoa(i)).Err())
+		}
+		waitAOFSize(t, path, func(size int64) bool { return size < 1024 })
+	})
+}
+
+func TestAOFPreamble(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63995"
+	srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+		options.AOFRewritePercentage = -1
+		options.AOFUseRDBPreamble = true
+	})
+	aofPath := filepath.Join(srv.path, "backup-aof.txt")
+	c := srv.start()
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Set(ctx, "counter", strconv.Itoa(i)).Err())
+		assert.NoError(t, c.RPush(ctx, "list", strconv.Itoa(i)).Err())
+	}
+	assert.NoError(t, c.SetEX(ctx, "session", "val", time.Hour).Err())
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, c.BgRewriteAOF(ctx).Err())
+	waitAOFSize(t, srv.path, func(size int64) bool { return size < info.Size()/2 })
+	// the tail after the preamble is plain records
+	assert.NoError(t, c.Set(ctx, "after", "val").Err())
+	assert.NoError(t, c.RPush(ctx, "list", "200").Err())
+	srv.stop()
+
+	b, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(b), "KVRDB"))
+	result, err := kvstore.CheckAOF(aofPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, result.Err)
+	assert.Equal(t, 2, result.Records)
+
+	c = srv.start()
+	if val, err := c.Get(ctx, "counter").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "199", val)
+	}
+	if val, err := c.LLen(ctx, "list").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, 201, val)
+	}
+	if val, err := c.TTL(ctx, "session").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.InDelta(t, time.Hour, val, float64(time.Second))
+	}
+	if val, err := c.Get(ctx, "after").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "val", val)
+	}
+
+	// a corrupted preamble can not be repaired by truncating
+	b[len("KVRDB")+4] ^= 0xff
+	if err := os.WriteFile(aofPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = kvstore.CheckAOF(aofPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, result.Err) {
+		assert.True(t, result.Err.Preamble)
+	}
+	_, err = kvstore.CheckAOF(aofPath, true)
+	assert.Error(t, err)
+}
+
+func TestLSMStorage(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63996"
+	srv := newBackupServer(t, addr, kvstore.BackupAOF, func(options *kvstore.ServerOptions) {
+		// a tiny memtable flushes and compacts segments all the time
+		storage, err := kvstore.OpenLSMStorage(filepath.Join(options.BackupPath, "lsm"), &kvstore.LSMOptions{MemtableSize: 256, MaxSegments: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.Storage = storage
+	})
+	lsmPath := filepath.Join(srv.path, "lsm")
+	c := srv.start()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.Set(ctx, fmt.Sprintf("key%d", i), strconv.Itoa(i)).Err())
+		assert.NoError(t, c.RPush(ctx, "list", strconv.Itoa(i)).Err())
+		assert.NoError(t, c.HSet(ctx, "hash", strconv.Itoa(i%10), strconv.Itoa(i)).Err())
+		assert.NoError(t, c.ZAdd(ctx, "zset", client.Z{Score: float64(i), Member: strconv.Itoa(i % 10)}).Err())
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, c.Del(ctx, fmt.Sprintf("key%d", i)).Err())
+	}
+	assert.NoError(t, c.SAdd(ctx, "set", "a", "b").Err())
+	segments, err := filepath.Glob(filepath.Join(lsmPath, "segment-*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, segments)
+
+	check := func(c *client.Client) {
+		for i := 0; i < 100; i++ {
+			if val, err := c.Get(ctx, fmt.Sprintf("key%d", i)).Result(); err != nil {
+				t.Fatal(err)
+			} else if i%2 == 0 {
+				assert.Equal(t, "", val)
+			} else {
+				assert.Equal(t, strconv.Itoa(i), val)
+			}
+		}
+		if val, err := c.LRange(ctx, "list", 0, 2).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, []string{"0", "1", "2"}, val)
+		}
+		if val, err := c.LLen(ctx, "list").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, 100, val)
+		}
+		if val, err := c.HGet(ctx, "hash", "3").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "93", val)
+		}
+		if val, err := c.ZScore(ctx, "zset", "3").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, float64(93), val)
+		}
+		if val, err := c.SIsMember(ctx, "set", "b").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.True(t, val)
+		}
+		if val, err := c.Keys(ctx).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Len(t, val, 54)
+		}
+	}
+	check(c)
+	srv.stop()
+
+	// the AOF is replayed into the storage instead of the segments kept on disk
+	c = srv.start()
+	check(c)
+}
+
+func TestLSMStorageReopen(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:64101"
+	dir := t.TempDir()
+	start := func() (*client.Client, func()) {
+		storage, err := kvstore.OpenLSMStorage(dir, &kvstore.LSMOptions{MemtableSize: 256, MaxSegments: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, stop := startTestServer(t, addr, &kvstore.ServerOptions{Storage: storage})
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, stop
+	}
+
+	c, stop := start()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.Set(ctx, fmt.Sprintf("key%d", i), strconv.Itoa(i)).Err())
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, c.Del(ctx, fmt.Sprintf("key%d", i)).Err())
+	}
+	// the last writes are only in the memtable until the storage is closed
+	assert.NoError(t, c.RPush(ctx, "list", "a", "b").Err())
+	stop()
+
+	// without a backup the keys are read back from the segments
+	c, _ = start()
+	if val, err := c.Keys(ctx).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Len(t, val, 51)
+	}
+	if val, err := c.Get(ctx, "key3").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, "3", val)
+	}
+	if val, err := c.Exists(ctx, "key4").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.False(t, val)
+	}
+	if val, err := c.LRange(ctx, "list", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, []string{"a", "b"}, val)
+	}
+	temps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, temps)
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63997"
+	run := func(options *kvstore.ServerOptions) chan error {
+		server := kvstore.New(addr)
+		startedCh := make(chan struct{}, 1)
+		options.StartedCh = startedCh
+		stoppedCh := make(chan error, 1)
+		go func() { stoppedCh <- server.Run(ctx, options) }()
+		select {
+		case <-startedCh:
+		case err := <-stoppedCh:
+			t.Fatalf("server %s stopped before it started: %v", addr, err)
+		}
+		return stoppedCh
+	}
+	wait := func(stoppedCh chan error) {
+		select {
+		case err := <-stoppedCh:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not stop")
+		}
+	}
+	snapshots := func(path string) []string {
+		snapshots, err := filepath.Glob(filepath.Join(path, "backup-*.rdb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshots
+	}
+
+	t.Run("save", func(t *testing.T) {
+		path := t.TempDir()
+		stoppedCh := run(&kvstore.ServerOptions{Backup: true, BackupType: kvstore.BackupAOF, BackupPath: path, AOFSync: kvstore.AOFSyncNo})
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an idle connection does not hold up the shutdown
+		idle, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = idle.Close() }()
+		assert.NoError(t, c.Set(ctx, "key", "val").Err())
+		if val, err := c.ShutdownSave(ctx).Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "OK", val)
+		}
+		wait(stoppedCh)
+		assert.Len(t, snapshots(path), 1)
+		result, err := kvstore.CheckAOF(filepath.Join(path, "backup-aof.txt"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, result.Records)
+	})
+
+	t.Run("nosave", func(t *testing.T) {
+		path := t.TempDir()
+		stoppedCh := run(&kvstore.ServerOptions{Backup: true, BackupType: kvstore.BackupRDB, BackupPath: path})
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, c.Set(ctx, "key", "val").Err())
+		assert.NoError(t, c.ShutdownNoSave(ctx).Err())
+		wait(stoppedCh)
+		assert.Empty(t, snapshots(path))
+	})
+
+	t.Run("save without backup", func(t *testing.T) {
+		stoppedCh := run(&kvstore.ServerOptions{})
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, c.ShutdownSave(ctx).Err())
+		assert.NoError(t, c.Shutdown(ctx).Err())
+		wait(stoppedCh)
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		// the blocked pop is woken up instead of holding the shutdown for ShutdownTimeout
+		stoppedCh := run(&kvstore.ServerOptions{ShutdownTimeout: time.Minute})
+		blocked, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = blocked.Close() }()
+		popErr := make(chan error, 1)
+		go func() { popErr <- blocked.BLPop(ctx, 0, "list").Err() }()
+		time.Sleep(100 * time.Millisecond)
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, c.Shutdown(ctx).Err())
+		wait(stoppedCh)
+		assert.Error(t, <-popErr)
+	})
+}
+
+func TestAOFTornTail(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63980"
+	path := t.TempDir()
+	aofPath := filepath.Join(path, "backup-aof.txt")
+	options := func(strict bool) *kvstore.ServerOptions {
+		return &kvstore.ServerOptions{Backup: true, BackupType: kvstore.BackupAOF, BackupPath: path, AOFStrict: strict}
+	}
+	_, stop := startTestServer(t, addr, options(false))
+	c, err := client.NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, c.Set(ctx, "key", "val").Err())
+	stop()
+	info, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves a partial record
+	f, err := os.OpenFile(aofPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("#1234abcd set key oth")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	t.Run("check", func(t *testing.T) {
+		result, err := kvstore.CheckAOF(aofPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.NotNil(t, result.Err) {
+			assert.True(t, result.Err.Tail)
+		}
+		assert.Equal(t, info.Size(), result.Valid)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		err := kvstore.New(addr).Run(ctx, options(true))
+		var corrupt *kvstore.AOFCorruptError
+		assert.ErrorAs(t, err, &corrupt)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		startTestServer(t, addr, options(false))
+		c, err := client.NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, err := c.Get(ctx, "key").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "val", val)
+		}
+		result, err := kvstore.CheckAOF(aofPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, result.Err)
+	})
+}
+
+func TestCheckAOF(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "backup-aof.txt")
+	// the checksum of the second record does not match its command
+	content := "set a 1\n#00000000 set b 2\nset c 3\n"
+	if err := os.WriteFile(aofPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := kvstore.CheckAOF(aofPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, result.Err) {
+		assert.False(t, result.Err.Tail)
+	}
+	assert.Equal(t, 1, result.Records)
+
+	result, err = kvstore.CheckAOF(aofPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, result.Fixed)
+	b, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "set a 1\n", string(b))
+}
+
+func TestReadsDoNotCreateKeys(t *testing.T) {
+	ctx := context.Background()
+	addr := "localhost:63990"
+	path := t.TempDir()
+	startTestServer(t, addr, &kvstore.ServerOptions{Backup: true, BackupType: kvstore.BackupAOF, BackupPath: path})
+	c, err := client.NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, c.Ping(ctx).Err())
+	assert.NoError(t, c.Get(ctx, "list").Err())
+	assert.NoError(t, c.LRange(ctx, "list", 0, -1).Err())
+	assert.NoError(t, c.LLen(ctx, "list").Err())
+	assert.NoError(t, c.LIndex(ctx, "list", 0).Err())
+	assert.NoError(t, c.LPop(ctx, "list", 1).Err())
+	assert.NoError(t, c.SMembers(ctx, "set").Err())
+	assert.NoError(t, c.SIsMember(ctx, "set", "a").Err())
+	if val, err := c.Keys(ctx).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Empty(t, val)
+	}
+
+	// only the writes, lpop and set, are logged
+	assert.NoError(t, c.Set(ctx, "key", "val").Err())
+	assert.NoError(t, c.Get(ctx, "key").Err())
+	result, err := kvstore.CheckAOF(filepath.Join(path, "backup-aof.txt"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, result.Records)
+}
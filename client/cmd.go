@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/zhan3333/kystore"
+	"slices"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type cmdable func(ctx context.Context, cmd Cmder) error
@@ -15,7 +17,7 @@ type Cmder interface {
 	String() string
 	SetErr(err error)
 	Err() error
-	setReplay(resp string)
+	readReply(r *replyReader) error
 }
 
 type baseCmd struct {
@@ -24,7 +26,7 @@ type baseCmd struct {
 	err  error
 }
 
-func (c baseCmd) SetErr(err error) {
+func (c *baseCmd) SetErr(err error) {
 	c.err = err
 }
 
@@ -37,6 +39,13 @@ var (
 	_ Cmder = (*StringCmd)(nil)
 	_ Cmder = (*StringSliceCmd)(nil)
 	_ Cmder = (*IntCmd)(nil)
+	_ Cmder = (*IntSliceCmd)(nil)
+	_ Cmder = (*BoolCmd)(nil)
+	_ Cmder = (*DurationCmd)(nil)
+	_ Cmder = (*MapStringStringCmd)(nil)
+	_ Cmder = (*FloatCmd)(nil)
+	_ Cmder = (*ZSliceCmd)(nil)
+	_ Cmder = (*ScanCmd)(nil)
 )
 
 /* status command*/
@@ -47,12 +56,17 @@ type StatusCmd struct {
 	val string
 }
 
-func (s *StatusCmd) setReplay(resp string) {
+func (s *StatusCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if err != nil {
+		return err
+	}
 	s.SetVal(resp)
+	return nil
 }
 
 func (s *StatusCmd) String() string {
-	return strings.Join(s.args, " ")
+	return kvstore.EncodeCmd(s.args...)
 }
 
 func (s *StatusCmd) SetVal(val string) {
@@ -83,6 +97,8 @@ type StringCmd struct {
 	baseCmd
 
 	val string
+	// nilErr fails a nil reply with Nil instead of reading it as an empty value
+	nilErr bool
 }
 
 func NewStringCmd(ctx context.Context, args ...string) *StringCmd {
@@ -92,15 +108,24 @@ func NewStringCmd(ctx context.Context, args ...string) *StringCmd {
 }
 
 func (s *StringCmd) String() string {
-	return strings.Join(s.args, " ")
+	return kvstore.EncodeCmd(s.args...)
 }
 
 func (s *StringCmd) Result() (string, error) {
 	return s.val, s.err
 }
 
-func (s *StringCmd) setReplay(resp string) {
+func (s *StringCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if errors.Is(err, Nil) && !s.nilErr {
+		// a nil reply, such as a missing key, is an empty value
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	s.val = resp
+	return nil
 }
 
 func (s *StringCmd) setArgs(args ...string) {
@@ -126,14 +151,16 @@ func NewStringSliceCmd(ctx context.Context, args ...string) *StringSliceCmd {
 }
 
 func (s *StringSliceCmd) String() string {
-	return strings.Join(s.args, " ")
+	return kvstore.EncodeCmd(s.args...)
 }
 
-func (s *StringSliceCmd) setReplay(resp string) {
-	if resp == "" {
-		return
+func (s *StringSliceCmd) readReply(r *replyReader) error {
+	vals, err := readArray(r)
+	if err != nil {
+		return err
 	}
-	s.vals = strings.Split(resp, ",")
+	s.vals = vals
+	return nil
 }
 
 func (s *StringSliceCmd) appendArgs(args ...string) {
@@ -159,22 +186,72 @@ func NewIntCmd(ctx context.Context, args ...string) *IntCmd {
 }
 
 func (i *IntCmd) String() string {
-	return strings.Join(i.args, " ")
+	return kvstore.EncodeCmd(i.args...)
 }
 
-func (i *IntCmd) setReplay(resp string) {
+func (i *IntCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if err != nil {
+		return err
+	}
 	v, err := strconv.Atoi(resp)
 	if err != nil {
-		i.SetErr(fmt.Errorf("parse response %s failed: %w", resp, err))
-		return
+		return fmt.Errorf("parse response %s failed: %w", resp, err)
 	}
 	i.val = v
+	return nil
+}
+
+func (i *IntCmd) appendArgs(args ...string) {
+	i.args = append(i.args, args...)
 }
 
 func (i *IntCmd) Result() (int, error) {
 	return i.val, i.err
 }
 
+/* int slice command*/
+
+type IntSliceCmd struct {
+	baseCmd
+
+	vals []int
+}
+
+func NewIntSliceCmd(ctx context.Context, args ...string) *IntSliceCmd {
+	return &IntSliceCmd{
+		baseCmd: baseCmd{ctx: ctx, args: args},
+	}
+}
+
+func (i *IntSliceCmd) String() string {
+	return kvstore.EncodeCmd(i.args...)
+}
+
+func (i *IntSliceCmd) readReply(r *replyReader) error {
+	vals, err := readArray(r)
+	if err != nil {
+		return err
+	}
+	i.vals = make([]int, 0, len(vals))
+	for _, val := range vals {
+		v, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("parse response %s failed: %w", val, err)
+		}
+		i.vals = append(i.vals, v)
+	}
+	return nil
+}
+
+func (i *IntSliceCmd) appendArgs(args ...string) {
+	i.args = append(i.args, args...)
+}
+
+func (i *IntSliceCmd) Result() ([]int, error) {
+	return i.vals, i.err
+}
+
 /* bool command*/
 
 type BoolCmd struct {
@@ -190,21 +267,235 @@ func NewBoolCmd(ctx context.Context, args ...string) *BoolCmd {
 }
 
 func (i *BoolCmd) String() string {
-	return strings.Join(i.args, " ")
+	return kvstore.EncodeCmd(i.args...)
 }
 
-func (i *BoolCmd) setReplay(resp string) {
+func (i *BoolCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if err != nil {
+		return err
+	}
 	if resp == "true" {
 		i.val = true
 	} else {
 		i.val = false
 	}
+	return nil
 }
 
 func (i *BoolCmd) Result() (bool, error) {
 	return i.val, i.err
 }
 
+/* duration command*/
+
+// DurationCmd holds a TTL, the special values -1 (no expire) and -2 (no key)
+// are returned as is.
+type DurationCmd struct {
+	baseCmd
+
+	val       time.Duration
+	precision time.Duration
+}
+
+func NewDurationCmd(ctx context.Context, precision time.Duration, args ...string) *DurationCmd {
+	return &DurationCmd{
+		baseCmd:   baseCmd{ctx: ctx, args: args},
+		precision: precision,
+	}
+}
+
+func (d *DurationCmd) String() string {
+	return kvstore.EncodeCmd(d.args...)
+}
+
+func (d *DurationCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseInt(resp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("parse response %s failed: %w", resp, err)
+	}
+	if v < 0 {
+		d.val = time.Duration(v)
+	} else {
+		d.val = time.Duration(v) * d.precision
+	}
+	return nil
+}
+
+func (d *DurationCmd) Result() (time.Duration, error) {
+	return d.val, d.err
+}
+
+/* map string string command*/
+
+type MapStringStringCmd struct {
+	baseCmd
+
+	val map[string]string
+}
+
+func NewMapStringStringCmd(ctx context.Context, args ...string) *MapStringStringCmd {
+	return &MapStringStringCmd{
+		baseCmd: baseCmd{ctx: ctx, args: args},
+	}
+}
+
+func (m *MapStringStringCmd) String() string {
+	return kvstore.EncodeCmd(m.args...)
+}
+
+func (m *MapStringStringCmd) readReply(r *replyReader) error {
+	vals, err := readArray(r)
+	if err != nil {
+		return err
+	}
+	if len(vals)%2 != 0 {
+		return fmt.Errorf("map reply has an odd number of elements: %d", len(vals))
+	}
+	m.val = make(map[string]string, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		m.val[vals[i]] = vals[i+1]
+	}
+	return nil
+}
+
+func (m *MapStringStringCmd) Result() (map[string]string, error) {
+	return m.val, m.err
+}
+
+/* float command*/
+
+type FloatCmd struct {
+	baseCmd
+
+	val float64
+}
+
+func NewFloatCmd(ctx context.Context, args ...string) *FloatCmd {
+	return &FloatCmd{
+		baseCmd: baseCmd{ctx: ctx, args: args},
+	}
+}
+
+func (f *FloatCmd) String() string {
+	return kvstore.EncodeCmd(f.args...)
+}
+
+func (f *FloatCmd) readReply(r *replyReader) error {
+	resp, err := readScalar(r)
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseFloat(resp, 64)
+	if err != nil {
+		return fmt.Errorf("parse response %s failed: %w", resp, err)
+	}
+	f.val = v
+	return nil
+}
+
+func (f *FloatCmd) Result() (float64, error) {
+	return f.val, f.err
+}
+
+/* sorted set slice command*/
+
+// Z is a sorted set member with its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ZSliceCmd reads a reply where every member is followed by its score.
+type ZSliceCmd struct {
+	baseCmd
+
+	val []Z
+}
+
+func NewZSliceCmd(ctx context.Context, args ...string) *ZSliceCmd {
+	return &ZSliceCmd{
+		baseCmd: baseCmd{ctx: ctx, args: args},
+	}
+}
+
+func (z *ZSliceCmd) String() string {
+	return kvstore.EncodeCmd(z.args...)
+}
+
+func (z *ZSliceCmd) readReply(r *replyReader) error {
+	vals, err := readArray(r)
+	if err != nil {
+		return err
+	}
+	if len(vals)%2 != 0 {
+		return fmt.Errorf("member score reply has an odd number of elements: %d", len(vals))
+	}
+	z.val = make([]Z, 0, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		score, err := strconv.ParseFloat(vals[i+1], 64)
+		if err != nil {
+			return fmt.Errorf("parse score %s failed: %w", vals[i+1], err)
+		}
+		z.val = append(z.val, Z{Score: score, Member: vals[i]})
+	}
+	return nil
+}
+
+func (z *ZSliceCmd) Result() ([]Z, error) {
+	return z.val, z.err
+}
+
+/* scan command*/
+
+// ScanCmd reads a page of a scan: the cursor of the next call followed by the
+// page elements.
+type ScanCmd struct {
+	baseCmd
+
+	page   []string
+	cursor uint64
+}
+
+func NewScanCmd(ctx context.Context, args ...string) *ScanCmd {
+	return &ScanCmd{
+		baseCmd: baseCmd{ctx: ctx, args: args},
+	}
+}
+
+func (s *ScanCmd) String() string {
+	return kvstore.EncodeCmd(s.args...)
+}
+
+func (s *ScanCmd) readReply(r *replyReader) error {
+	vals, err := readArray(r)
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return errors.New("scan reply has no cursor")
+	}
+	cursor, err := strconv.ParseUint(vals[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("parse cursor %s failed: %w", vals[0], err)
+	}
+	s.cursor, s.page = cursor, vals[1:]
+	return nil
+}
+
+func (s *ScanCmd) appendArgs(args ...string) {
+	s.args = append(s.args, args...)
+}
+
+// Result returns the page and the cursor of the next call, 0 once the scan is done.
+func (s *ScanCmd) Result() ([]string, uint64, error) {
+	return s.page, s.cursor, s.err
+}
+
 /* commands */
 
 func (c cmdable) Ping(ctx context.Context) *StatusCmd {
@@ -214,6 +505,38 @@ func (c cmdable) Ping(ctx context.Context) *StatusCmd {
 	return cmd
 }
 
+// BgRewriteAOF starts rewriting the AOF in the background.
+func (c cmdable) BgRewriteAOF(ctx context.Context) *StatusCmd {
+	cmd := NewStatusCmd(ctx, "bgrewriteaof")
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// Shutdown stops the server, it writes an RDB snapshot when that is the backup type.
+func (c cmdable) Shutdown(ctx context.Context) *StatusCmd {
+	cmd := NewStatusCmd(ctx, "shutdown")
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// ShutdownSave stops the server after writing an RDB snapshot.
+func (c cmdable) ShutdownSave(ctx context.Context) *StatusCmd {
+	cmd := NewStatusCmd(ctx, "shutdown", "save")
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// ShutdownNoSave stops the server without writing an RDB snapshot.
+func (c cmdable) ShutdownNoSave(ctx context.Context) *StatusCmd {
+	cmd := NewStatusCmd(ctx, "shutdown", "nosave")
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
 func (c cmdable) Set(ctx context.Context, kvs ...string) *StringCmd {
 	cmd := NewStringCmd(ctx, "set")
 
@@ -267,6 +590,104 @@ func (c cmdable) Exists(ctx context.Context, key string) *BoolCmd {
 	return cmd
 }
 
+// SetEX sets key to val with an expiration, it is sent with millisecond precision.
+func (c cmdable) SetEX(ctx context.Context, key string, val string, expiration time.Duration) *StringCmd {
+	cmd := NewStringCmd(ctx, "set", key, val, "px", strconv.FormatInt(expiration.Milliseconds(), 10))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if expiration < time.Millisecond {
+		cmd.SetErr(errors.New("invalid expiration"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+/* expire */
+
+func (c cmdable) Expire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	cmd := NewBoolCmd(ctx, "expire", key, strconv.FormatInt(int64(expiration/time.Second), 10))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) PExpire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	cmd := NewBoolCmd(ctx, "pexpire", key, strconv.FormatInt(expiration.Milliseconds(), 10))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) PExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	cmd := NewBoolCmd(ctx, "pexpireat", key, strconv.FormatInt(tm.UnixMilli(), 10))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) TTL(ctx context.Context, key string) *DurationCmd {
+	cmd := NewDurationCmd(ctx, time.Second, "ttl", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) PTTL(ctx context.Context, key string) *DurationCmd {
+	cmd := NewDurationCmd(ctx, time.Millisecond, "pttl", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) Persist(ctx context.Context, key string) *BoolCmd {
+	cmd := NewBoolCmd(ctx, "persist", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
 /* list */
 
 func (c cmdable) LPush(ctx context.Context, key string, values ...string) *StringCmd {
@@ -329,6 +750,26 @@ func (c cmdable) LPop(ctx context.Context, key string, n int) *StringSliceCmd {
 	return cmd
 }
 
+func (c cmdable) RPop(ctx context.Context, key string, n int) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "rpop")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if n < 1 {
+		cmd.SetErr(errors.New("invalid n value"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	cmd.appendArgs(strconv.Itoa(n))
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
 func (c cmdable) LRange(ctx context.Context, key string, start, stop int) *StringSliceCmd {
 	cmd := NewStringSliceCmd(ctx, "lrange")
 
@@ -377,8 +818,8 @@ func (c cmdable) LIndex(ctx context.Context, key string, i int) *StringCmd {
 	return cmd
 }
 
-func (c cmdable) LLen(ctx context.Context, key string) *IntCmd {
-	cmd := NewIntCmd(ctx, "llen", key)
+func (c cmdable) LSet(ctx context.Context, key string, index int, value string) *StatusCmd {
+	cmd := NewStatusCmd(ctx, "lset", key, strconv.Itoa(index), value)
 
 	if key == "" {
 		cmd.SetErr(errors.New("invalid key"))
@@ -390,9 +831,222 @@ func (c cmdable) LLen(ctx context.Context, key string) *IntCmd {
 	return cmd
 }
 
-/* set */
+// LInsert inserts value before or after pivot, op is "BEFORE" or "AFTER". The
+// result is the new length, or -1 when pivot is not in the list.
+func (c cmdable) LInsert(ctx context.Context, key, op string, pivot, value string) *IntCmd {
+	cmd := NewIntCmd(ctx, "linsert")
 
-func (c cmdable) SAdd(ctx context.Context, key string, values ...string) *StringCmd {
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, op, pivot, value)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) LInsertBefore(ctx context.Context, key string, pivot, value string) *IntCmd {
+	return c.LInsert(ctx, key, "BEFORE", pivot, value)
+}
+
+func (c cmdable) LInsertAfter(ctx context.Context, key string, pivot, value string) *IntCmd {
+	return c.LInsert(ctx, key, "AFTER", pivot, value)
+}
+
+func (c cmdable) LRem(ctx context.Context, key string, count int, value string) *IntCmd {
+	cmd := NewIntCmd(ctx, "lrem")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, strconv.Itoa(count), value)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// LPosArgs are the options of LPOS, zero values are left out.
+type LPosArgs struct {
+	Rank   int
+	MaxLen int
+}
+
+func (a LPosArgs) args() []string {
+	var args []string
+	if a.Rank != 0 {
+		args = append(args, "RANK", strconv.Itoa(a.Rank))
+	}
+	if a.MaxLen != 0 {
+		args = append(args, "MAXLEN", strconv.Itoa(a.MaxLen))
+	}
+	return args
+}
+
+// LPos returns the index of value in the list, Nil when there is none.
+func (c cmdable) LPos(ctx context.Context, key string, value string, a LPosArgs) *IntCmd {
+	cmd := NewIntCmd(ctx, "lpos")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, value)
+	cmd.appendArgs(a.args()...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// LPosCount returns the indexes of up to count matches of value, count 0
+// returns all of them.
+func (c cmdable) LPosCount(ctx context.Context, key string, value string, count int, a LPosArgs) *IntSliceCmd {
+	cmd := NewIntSliceCmd(ctx, "lpos")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, value, "COUNT", strconv.Itoa(count))
+	cmd.appendArgs(a.args()...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// LMove pops an element from the srcpos end of source and pushes it to the
+// destpos end of destination, the positions are "LEFT" or "RIGHT".
+func (c cmdable) LMove(ctx context.Context, source, destination, srcpos, destpos string) *StringCmd {
+	cmd := NewStringCmd(ctx, "lmove")
+
+	if source == "" || destination == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(source, destination, srcpos, destpos)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) RPopLPush(ctx context.Context, source, destination string) *StringCmd {
+	cmd := NewStringCmd(ctx, "rpoplpush")
+
+	if source == "" || destination == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(source, destination)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) LLen(ctx context.Context, key string) *IntCmd {
+	cmd := NewIntCmd(ctx, "llen", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// blockingTimeout formats timeout in seconds, 0 blocks forever. It is cut to
+// the deadline of ctx, so the server gives up the pop when the call does.
+func blockingTimeout(ctx context.Context, timeout time.Duration) string {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); timeout == 0 || left < timeout {
+			timeout = max(left, time.Millisecond)
+		}
+	}
+	return strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+}
+
+// blockingErr returns the error of ctx when the server timed out at the
+// deadline of ctx.
+func blockingErr(ctx context.Context, cmd Cmder) {
+	if errors.Is(cmd.Err(), Nil) && ctx.Err() != nil {
+		cmd.SetErr(ctx.Err())
+	}
+}
+
+// BLPop pops the first element of the first non-empty list of keys, blocking
+// until one of them receives an element. The result is the key and the
+// element, Nil once timeout elapsed, a zero timeout blocks until ctx is done.
+// Clients blocked on a key are served in the order they blocked.
+func (c cmdable) BLPop(ctx context.Context, timeout time.Duration, keys ...string) *StringSliceCmd {
+	return c.bPop(ctx, "blpop", timeout, keys...)
+}
+
+// BRPop is BLPop popping the last element.
+func (c cmdable) BRPop(ctx context.Context, timeout time.Duration, keys ...string) *StringSliceCmd {
+	return c.bPop(ctx, "brpop", timeout, keys...)
+}
+
+func (c cmdable) bPop(ctx context.Context, name string, timeout time.Duration, keys ...string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, name)
+
+	if len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if timeout < 0 {
+		cmd.SetErr(errors.New("invalid timeout value"))
+		return cmd
+	}
+
+	cmd.appendArgs(keys...)
+	cmd.appendArgs(blockingTimeout(ctx, timeout))
+
+	_ = c(ctx, cmd)
+	blockingErr(ctx, cmd)
+
+	return cmd
+}
+
+// BLMove is LMove blocking until source receives an element, the result is
+// Nil once timeout elapsed.
+func (c cmdable) BLMove(ctx context.Context, source, destination, srcpos, destpos string, timeout time.Duration) *StringCmd {
+	cmd := NewStringCmd(ctx, "blmove")
+
+	if source == "" || destination == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if timeout < 0 {
+		cmd.SetErr(errors.New("invalid timeout value"))
+		return cmd
+	}
+
+	cmd.appendArgs(source, destination, srcpos, destpos, blockingTimeout(ctx, timeout))
+	cmd.nilErr = true
+
+	_ = c(ctx, cmd)
+	blockingErr(ctx, cmd)
+
+	return cmd
+}
+
+/* set */
+
+func (c cmdable) SAdd(ctx context.Context, key string, values ...string) *StringCmd {
 	cmd := NewStringCmd(ctx, "sadd")
 
 	if key == "" {
@@ -427,6 +1081,52 @@ func (c cmdable) SMembers(ctx context.Context, key string) *StringSliceCmd {
 	return cmd
 }
 
+// SMembersSorted returns the members in lexicographic order.
+func (c cmdable) SMembersSorted(ctx context.Context, key string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "smembers")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, "SORTED")
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SScan returns a page of about count members from cursor on, which start at
+// 0, and the cursor of the next page, 0 once every member was returned. A
+// member in the set for the whole scan is returned once. Only the members
+// matching the glob pattern match are returned when it is not empty, so a page
+// may be empty before the scan is done. A zero count uses the server default.
+func (c cmdable) SScan(ctx context.Context, key string, cursor uint64, match string, count int) *ScanCmd {
+	cmd := NewScanCmd(ctx, "sscan")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if count < 0 {
+		cmd.SetErr(errors.New("invalid count value"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, strconv.FormatUint(cursor, 10))
+	if match != "" {
+		cmd.appendArgs("MATCH", match)
+	}
+	if count > 0 {
+		cmd.appendArgs("COUNT", strconv.Itoa(count))
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
 func (c cmdable) SIsMember(ctx context.Context, key string, val string) *BoolCmd {
 	cmd := NewBoolCmd(ctx, "sismember", key, val)
 
@@ -439,3 +1139,543 @@ func (c cmdable) SIsMember(ctx context.Context, key string, val string) *BoolCmd
 
 	return cmd
 }
+
+// SRem removes members from the set and returns the number of removed members.
+func (c cmdable) SRem(ctx context.Context, key string, members ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "srem")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if len(members) == 0 {
+		cmd.SetErr(errors.New("invalid members number"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	cmd.appendArgs(members...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) SCard(ctx context.Context, key string) *IntCmd {
+	cmd := NewIntCmd(ctx, "scard", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SPop removes and returns a random member, the result is empty when the set
+// does not exist.
+func (c cmdable) SPop(ctx context.Context, key string) *StringCmd {
+	cmd := NewStringCmd(ctx, "spop")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SPopN removes and returns up to count random members.
+func (c cmdable) SPopN(ctx context.Context, key string, count int) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "spop")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if count < 0 {
+		cmd.SetErr(errors.New("invalid count value"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, strconv.Itoa(count))
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SRandMember returns a random member, the result is empty when the set does
+// not exist.
+func (c cmdable) SRandMember(ctx context.Context, key string) *StringCmd {
+	cmd := NewStringCmd(ctx, "srandmember")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SRandMemberN returns count distinct random members, or -count members which
+// may repeat when count is negative.
+func (c cmdable) SRandMemberN(ctx context.Context, key string, count int) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "srandmember")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(key, strconv.Itoa(count))
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SMove moves member from the source set to the destination set, the result
+// is false when member is not in source.
+func (c cmdable) SMove(ctx context.Context, source, destination string, member string) *BoolCmd {
+	cmd := NewBoolCmd(ctx, "smove", source, destination, member)
+
+	if source == "" || destination == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SInter returns the members in all the sets of keys.
+func (c cmdable) SInter(ctx context.Context, keys ...string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "sinter")
+
+	if len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SInterStore stores the result of SInter at destination and returns its length.
+func (c cmdable) SInterStore(ctx context.Context, destination string, keys ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "sinterstore")
+
+	if destination == "" || len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(destination)
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SUnion returns the members in any set of keys.
+func (c cmdable) SUnion(ctx context.Context, keys ...string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "sunion")
+
+	if len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SUnionStore stores the result of SUnion at destination and returns its length.
+func (c cmdable) SUnionStore(ctx context.Context, destination string, keys ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "sunionstore")
+
+	if destination == "" || len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(destination)
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SDiff returns the members of the first set in none of the other sets.
+func (c cmdable) SDiff(ctx context.Context, keys ...string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "sdiff")
+
+	if len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// SDiffStore stores the result of SDiff at destination and returns its length.
+func (c cmdable) SDiffStore(ctx context.Context, destination string, keys ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "sdiffstore")
+
+	if destination == "" || len(keys) == 0 || slices.Contains(keys, "") {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	cmd.appendArgs(destination)
+	cmd.appendArgs(keys...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+/* hash */
+
+func (c cmdable) HSet(ctx context.Context, key string, fieldValues ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "hset")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if len(fieldValues) == 0 || len(fieldValues)%2 != 0 {
+		cmd.SetErr(errors.New("invalid field values number"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	cmd.appendArgs(fieldValues...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HGet(ctx context.Context, key string, field string) *StringCmd {
+	cmd := NewStringCmd(ctx, "hget", key, field)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HDel(ctx context.Context, key string, fields ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "hdel")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if len(fields) == 0 {
+		cmd.SetErr(errors.New("invalid fields number"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	cmd.appendArgs(fields...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HGetAll(ctx context.Context, key string) *MapStringStringCmd {
+	cmd := NewMapStringStringCmd(ctx, "hgetall", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HIncrBy(ctx context.Context, key string, field string, incr int64) *IntCmd {
+	cmd := NewIntCmd(ctx, "hincrby", key, field, strconv.FormatInt(incr, 10))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HKeys(ctx context.Context, key string) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "hkeys", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) HLen(ctx context.Context, key string) *IntCmd {
+	cmd := NewIntCmd(ctx, "hlen", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+/* sorted set */
+
+// ZRangeBy is a score range, Min and Max accept "-inf", "+inf" and the "("
+// prefix for an exclusive bound. A non zero Offset or Count adds a LIMIT.
+type ZRangeBy struct {
+	Min, Max      string
+	Offset, Count int64
+}
+
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (c cmdable) ZAdd(ctx context.Context, key string, members ...Z) *IntCmd {
+	cmd := NewIntCmd(ctx, "zadd")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if len(members) == 0 {
+		cmd.SetErr(errors.New("invalid members number"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	for _, m := range members {
+		cmd.appendArgs(formatScore(m.Score), m.Member)
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRem(ctx context.Context, key string, members ...string) *IntCmd {
+	cmd := NewIntCmd(ctx, "zrem")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+	if len(members) == 0 {
+		cmd.SetErr(errors.New("invalid members number"))
+		return cmd
+	}
+
+	cmd.appendArgs(key)
+	cmd.appendArgs(members...)
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// ZScore returns the score of member, Nil when the member does not exist.
+func (c cmdable) ZScore(ctx context.Context, key string, member string) *FloatCmd {
+	cmd := NewFloatCmd(ctx, "zscore", key, member)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// ZRank returns the rank of member ordered from the lowest score, Nil when the
+// member does not exist.
+func (c cmdable) ZRank(ctx context.Context, key string, member string) *IntCmd {
+	cmd := NewIntCmd(ctx, "zrank", key, member)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+// ZRevRank returns the rank of member ordered from the highest score, Nil when
+// the member does not exist.
+func (c cmdable) ZRevRank(ctx context.Context, key string, member string) *IntCmd {
+	cmd := NewIntCmd(ctx, "zrevrank", key, member)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRange(ctx context.Context, key string, start, stop int) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "zrange", key, strconv.Itoa(start), strconv.Itoa(stop))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRangeWithScores(ctx context.Context, key string, start, stop int) *ZSliceCmd {
+	cmd := NewZSliceCmd(ctx, "zrange", key, strconv.Itoa(start), strconv.Itoa(stop), "withscores")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRevRange(ctx context.Context, key string, start, stop int) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, "zrevrange", key, strconv.Itoa(start), strconv.Itoa(stop))
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRevRangeWithScores(ctx context.Context, key string, start, stop int) *ZSliceCmd {
+	cmd := NewZSliceCmd(ctx, "zrevrange", key, strconv.Itoa(start), strconv.Itoa(stop), "withscores")
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func zRangeByArgs(key string, opt *ZRangeBy, withScores bool) []string {
+	args := []string{"zrangebyscore", key, opt.Min, opt.Max}
+	if withScores {
+		args = append(args, "withscores")
+	}
+	if opt.Offset != 0 || opt.Count != 0 {
+		args = append(args, "limit", strconv.FormatInt(opt.Offset, 10), strconv.FormatInt(opt.Count, 10))
+	}
+	return args
+}
+
+func (c cmdable) ZRangeByScore(ctx context.Context, key string, opt *ZRangeBy) *StringSliceCmd {
+	cmd := NewStringSliceCmd(ctx, zRangeByArgs(key, opt, false)...)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZRangeByScoreWithScores(ctx context.Context, key string, opt *ZRangeBy) *ZSliceCmd {
+	cmd := NewZSliceCmd(ctx, zRangeByArgs(key, opt, true)...)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZIncrBy(ctx context.Context, key string, increment float64, member string) *FloatCmd {
+	cmd := NewFloatCmd(ctx, "zincrby", key, formatScore(increment), member)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
+
+func (c cmdable) ZCard(ctx context.Context, key string) *IntCmd {
+	cmd := NewIntCmd(ctx, "zcard", key)
+
+	if key == "" {
+		cmd.SetErr(errors.New("invalid key"))
+		return cmd
+	}
+
+	_ = c(ctx, cmd)
+
+	return cmd
+}
@@ -0,0 +1,228 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kvstore "github.com/zhan3333/kystore"
+	"github.com/zhan3333/kystore/client"
+)
+
+type raftTestNode struct {
+	addr     string
+	raftAddr string
+	dataDir  string
+	server   *kvstore.Server
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+}
+
+func startRaftGroup(t *testing.T, basePort int, size int) []*raftTestNode {
+	nodes := make([]*raftTestNode, size)
+	for i := range nodes {
+		nodes[i] = &raftTestNode{
+			addr:     fmt.Sprintf("localhost:%d", basePort+i),
+			raftAddr: fmt.Sprintf("localhost:%d", basePort+100+i),
+			dataDir:  t.TempDir(),
+		}
+	}
+	for _, node := range nodes {
+		node.start(t, nodes)
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	})
+	return nodes
+}
+
+func (n *raftTestNode) start(t *testing.T, group []*raftTestNode) {
+	var peers []string
+	for _, other := range group {
+		if other != n {
+			peers = append(peers, other.raftAddr)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n.server = kvstore.New(n.addr)
+	n.cancel = cancel
+	n.stopped = make(chan struct{})
+	startedCh := make(chan struct{}, 1)
+	go func() {
+		defer close(n.stopped)
+		_ = n.server.Run(ctx, &kvstore.ServerOptions{
+			StartedCh: startedCh,
+			Raft: &kvstore.RaftOptions{
+				Addr:              n.raftAddr,
+				Peers:             peers,
+				DataDir:           n.dataDir,
+				ElectionTimeout:   150 * time.Millisecond,
+				HeartbeatInterval: 30 * time.Millisecond,
+			},
+		})
+	}()
+	select {
+	case <-startedCh:
+	case <-n.stopped:
+		t.Fatalf("server %s stopped before it started", n.addr)
+	}
+}
+
+func (n *raftTestNode) stop() {
+	if n.cancel != nil {
+		n.cancel()
+		<-n.stopped
+		n.cancel = nil
+	}
+}
+
+func waitLeader(t *testing.T, nodes []*raftTestNode) *raftTestNode {
+	var leader *raftTestNode
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.cancel != nil && node.server.IsLeader() {
+				leader = node
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+	return leader
+}
+
+func TestRaftReplication(t *testing.T) {
+	nodes := startRaftGroup(t, 63900, 3)
+	leader := waitLeader(t, nodes)
+
+	leaderCli, err := client.NewClient(leader.addr)
+	require.NoError(t, err)
+	assert.NoError(t, leaderCli.Set(context.Background(), "raftkey", "val").Err())
+	assert.NoError(t, leaderCli.RPush(context.Background(), "raftlist", "a", "b").Err())
+	// the followers pop the same random members as the leader
+	assert.NoError(t, leaderCli.SAdd(context.Background(), "raftset", "a", "b", "c", "d", "e").Err())
+	assert.NoError(t, leaderCli.SPopN(context.Background(), "raftset", 2).Err())
+	remaining, err := leaderCli.SMembers(context.Background(), "raftset").Result()
+	require.NoError(t, err)
+	sort.Strings(remaining)
+
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		follower, err := client.NewClient(node.addr)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			val, err := follower.Get(context.Background(), "raftkey").Result()
+			return err == nil && val == "val"
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			val, err := follower.SMembers(context.Background(), "raftset").Result()
+			sort.Strings(val)
+			return err == nil && assert.ObjectsAreEqual(remaining, val)
+		}, 2*time.Second, 20*time.Millisecond)
+
+		err = follower.Set(context.Background(), "raftkey", "other").Err()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not leader")
+		}
+	}
+
+	t.Run("survives leader loss", func(t *testing.T) {
+		leader.stop()
+		newLeader := waitLeader(t, nodes)
+		assert.NotEqual(t, leader.addr, newLeader.addr)
+
+		cli, err := client.NewClient(newLeader.addr)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			val, err := cli.LRange(context.Background(), "raftlist", 0, -1).Result()
+			return err == nil && assert.ObjectsAreEqual([]string{"a", "b"}, val)
+		}, 2*time.Second, 20*time.Millisecond)
+
+		assert.NoError(t, cli.Set(context.Background(), "raftkey2", "val2").Err())
+		if val, err := cli.Get(context.Background(), "raftkey2").Result(); err != nil {
+			t.Fatal(err)
+		} else {
+			assert.Equal(t, "val2", val)
+		}
+	})
+}
+
+func TestRaftRestart(t *testing.T) {
+	nodes := startRaftGroup(t, 63910, 1)
+	node := waitLeader(t, nodes)
+
+	cli, err := client.NewClient(node.addr)
+	require.NoError(t, err)
+	assert.NoError(t, cli.LPush(context.Background(), "restartlist", "a", "b").Err())
+
+	node.stop()
+	node.start(t, nodes)
+	waitLeader(t, nodes)
+
+	cli, err = client.NewClient(node.addr)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		val, err := cli.LRange(context.Background(), "restartlist", 0, -1).Result()
+		return err == nil && assert.ObjectsAreEqual([]string{"b", "a"}, val)
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// the log is not compacted, it keeps the entries of the previous run
+	stats, ok := node.server.RaftStats()
+	require.True(t, ok)
+	assert.True(t, stats.Leader)
+	// a no-op per leadership and the push
+	assert.GreaterOrEqual(t, stats.LogEntries, 3)
+	if info, err := os.Stat(filepath.Join(node.dataDir, "raft-log.json")); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, info.Size(), stats.LogBytes)
+	}
+	_, ok = kvstore.New("localhost:0").RaftStats()
+	assert.False(t, ok)
+}
+
+func TestRaftExpireReplay(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftGroup(t, 63915, 1)
+	node := waitLeader(t, nodes)
+
+	cli, err := client.NewClient(node.addr)
+	require.NoError(t, err)
+	assert.NoError(t, cli.RPush(ctx, "expired", "a").Err())
+	assert.NoError(t, cli.PExpire(ctx, "expired", 100*time.Millisecond).Err())
+	assert.NoError(t, cli.RPush(ctx, "expired", "b").Err())
+	assert.NoError(t, cli.RPush(ctx, "recreated", "a").Err())
+	assert.NoError(t, cli.PExpire(ctx, "recreated", 100*time.Millisecond).Err())
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, cli.RPush(ctx, "recreated", "b").Err())
+
+	// the log is replayed after the deadlines passed, the expiries are logged
+	node.stop()
+	node.start(t, nodes)
+	waitLeader(t, nodes)
+	cli, err = client.NewClient(node.addr)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		val, err := cli.LRange(ctx, "recreated", 0, -1).Result()
+		return err == nil && assert.ObjectsAreEqual([]string{"b"}, val)
+	}, 2*time.Second, 20*time.Millisecond)
+	if val, err := cli.LRange(ctx, "expired", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Empty(t, val)
+	}
+	if val, err := cli.PTTL(ctx, "recreated").Result(); err != nil {
+		t.Fatal(err)
+	} else {
+		assert.Equal(t, time.Duration(-1), val)
+	}
+}
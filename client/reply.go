@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zhan3333/kystore"
+)
+
+// replyError is an error reply sent by the server.
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// replyReader reads the frames of a reply and enforces the max reply size.
+type replyReader struct {
+	r   *bufio.Reader
+	max int
+	n   int
+}
+
+func (rr *replyReader) reset() {
+	rr.n = 0
+}
+
+func (rr *replyReader) consume(n int) error {
+	rr.n += n
+	if rr.n > rr.max {
+		return ErrReplyTooLarge
+	}
+	return nil
+}
+
+// readLine reads a scalar reply terminated by kvstore.LineSuffix, an error
+// reply is returned as error.
+func readLine(rr *replyReader) (string, error) {
+	var buf []byte
+	for {
+		b, err := rr.r.ReadSlice('\n')
+		if err := rr.consume(len(b)); err != nil {
+			return "", err
+		}
+		buf = append(buf, b...)
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				continue
+			}
+			return "", err
+		}
+		if line := string(buf); strings.HasSuffix(line, kvstore.LineSuffix) {
+			line = strings.TrimSuffix(line, kvstore.LineSuffix)
+			if strings.HasPrefix(line, kvstore.ErrorPrefix) {
+				return "", replyError(strings.TrimPrefix(line, kvstore.ErrorPrefix))
+			}
+			return line, nil
+		}
+	}
+}
+
+// readScalar reads a scalar reply: a string framed as "$<len>" followed by the
+// raw bytes, Nil for "$-1", or a single line status, integer or boolean.
+func readScalar(rr *replyReader) (string, error) {
+	line, err := readLine(rr)
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return line, nil
+	}
+	size, err := readLength(line, '$')
+	if err != nil {
+		return "", err
+	}
+	if size < 0 {
+		return "", Nil
+	}
+	return readBulk(rr, size)
+}
+
+// readArray reads a framed array reply: "*<n>" followed by n "$<len>"
+// prefixed elements, a nil element is read as an empty string and a nil
+// reply returns Nil.
+func readArray(rr *replyReader) ([]string, error) {
+	line, err := readLine(rr)
+	if err != nil {
+		return nil, err
+	}
+	if line == "$-1" {
+		return nil, Nil
+	}
+	n, err := readLength(line, '*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, nil
+	}
+	// the count is not trusted for preallocation, elements are checked as they are read
+	vals := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		line, err := readLine(rr)
+		if err != nil {
+			return nil, err
+		}
+		size, err := readLength(line, '$')
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			vals = append(vals, "")
+			continue
+		}
+		val, err := readBulk(rr, size)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
+}
+
+// readBulk reads the size raw bytes of a string and their LineSuffix.
+func readBulk(rr *replyReader, size int) (string, error) {
+	if err := rr.consume(size + len(kvstore.LineSuffix)); err != nil {
+		return "", err
+	}
+	b := make([]byte, size+len(kvstore.LineSuffix))
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return "", err
+	}
+	if string(b[size:]) != kvstore.LineSuffix {
+		return "", errors.New("string is not terminated")
+	}
+	return string(b[:size]), nil
+}
+
+func readLength(line string, prefix byte) (int, error) {
+	if len(line) == 0 || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected reply %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 {
+		return 0, fmt.Errorf("invalid length %q", line)
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+package client_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func respCommand(args ...string) string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		_, _ = fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return sb.String()
+}
+
+// respRoundTrip sends one command and reads the given number of reply lines.
+func respRoundTrip(t *testing.T, conn net.Conn, reader *bufio.Reader, lines int, args ...string) string {
+	_, err := conn.Write([]byte(respCommand(args...)))
+	require.NoError(t, err)
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+func TestRESP(t *testing.T) {
+	conn, err := net.Dial("tcp", serverAddr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+
+	t.Run("resp2", func(t *testing.T) {
+		assert.Equal(t, "+pong\r\n", respRoundTrip(t, conn, reader, 1, "PING"))
+		assert.Equal(t, "+OK\r\n", respRoundTrip(t, conn, reader, 1, "SET", "respkey", "hello world"))
+		assert.Equal(t, "$11\r\nhello world\r\n", respRoundTrip(t, conn, reader, 2, "GET", "respkey"))
+		assert.Equal(t, "$-1\r\n", respRoundTrip(t, conn, reader, 1, "GET", "respmissing"))
+		assert.Equal(t, ":1\r\n", respRoundTrip(t, conn, reader, 1, "EXISTS", "respkey"))
+		assert.Equal(t, ":2\r\n", respRoundTrip(t, conn, reader, 1, "RPUSH", "resplist", "a", "b,c"))
+		assert.Equal(t, ":2\r\n", respRoundTrip(t, conn, reader, 1, "LLEN", "resplist"))
+		assert.Equal(t, "*2\r\n$1\r\na\r\n$3\r\nb,c\r\n", respRoundTrip(t, conn, reader, 5, "LRANGE", "resplist", "0", "-1"))
+		assert.Equal(t, ":3\r\n", respRoundTrip(t, conn, reader, 1, "LPUSH", "resplist", "z"))
+		assert.Equal(t, "$1\r\nz\r\n", respRoundTrip(t, conn, reader, 2, "LPOP", "resplist"))
+		assert.Equal(t, "*1\r\n$3\r\nb,c\r\n", respRoundTrip(t, conn, reader, 3, "RPOP", "resplist", "1"))
+		assert.Equal(t, "$-1\r\n", respRoundTrip(t, conn, reader, 1, "RPOP", "respmissing"))
+		assert.Equal(t, ":1\r\n", respRoundTrip(t, conn, reader, 1, "SADD", "respscan", "a"))
+		assert.Equal(t, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n", respRoundTrip(t, conn, reader, 6, "SSCAN", "respscan", "0"))
+		assert.Equal(t, "*2\r\n$1\r\n0\r\n*0\r\n", respRoundTrip(t, conn, reader, 4, "SSCAN", "respmissing", "0"))
+		assert.Equal(t, ":3\r\n", respRoundTrip(t, conn, reader, 1, "DEL", "respkey", "resplist", "respscan", "respmissing"))
+		assert.Equal(t, "-ERR unknown command: NOPE\r\n", respRoundTrip(t, conn, reader, 1, "NOPE"))
+	})
+
+	t.Run("resp3", func(t *testing.T) {
+		assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", respRoundTrip(t, conn, reader, 1, "HELLO", "4"))
+		assert.Equal(t, "%7\r\n$6\r\nserver\r\n$7\r\nkvstore\r\n", respRoundTrip(t, conn, reader, 5, "HELLO", "3"))
+		// drain the rest of the HELLO map
+		for i := 0; i < 21; i++ {
+			_, err := reader.ReadString('\n')
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "_\r\n", respRoundTrip(t, conn, reader, 1, "GET", "respmissing"))
+		assert.Equal(t, ":1\r\n", respRoundTrip(t, conn, reader, 1, "SADD", "respset", "a", "a"))
+		assert.Equal(t, "~1\r\n$1\r\na\r\n", respRoundTrip(t, conn, reader, 3, "SMEMBERS", "respset"))
+		// the SPOP seed is added by the server for the AOF and the Raft log only
+		assert.Contains(t, respRoundTrip(t, conn, reader, 1, "SPOP", "respset", "1", "SEED", "1"), "-ERR invalid args number")
+	})
+}
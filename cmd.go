@@ -1,6 +1,9 @@
 package kvstore
 
-import "strings"
+import (
+	"errors"
+	"strings"
+)
 
 type Cmd struct {
 	Name     string
@@ -8,11 +11,199 @@ type Cmd struct {
 	FullName string
 }
 
-func NewCmd(c string) *Cmd {
-	sp := strings.Split(c, " ")
-	cmd := &Cmd{FullName: c, Name: sp[0]}
-	if len(sp) > 1 {
-		cmd.Args = sp[1:]
+// NewCmd parses a command line. Arguments are separated by whitespace and may
+// be quoted: double quotes support the \n, \r, \t, \b, \a, \xHH escapes and
+// escape any other character with a backslash, single quotes only escape \'.
+func NewCmd(c string) (*Cmd, error) {
+	args, err := splitArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &Cmd{FullName: c}
+	if len(args) > 0 {
+		cmd.Name = strings.ToLower(args[0])
+		cmd.Args = args[1:]
+	}
+	return cmd, nil
+}
+
+// NewCmdArgs builds a command from already split arguments, as sent by RESP clients.
+func NewCmdArgs(args []string) *Cmd {
+	cmd := &Cmd{FullName: EncodeCmd(args...)}
+	if len(args) > 0 {
+		cmd.Name = strings.ToLower(args[0])
+		cmd.Args = args[1:]
 	}
 	return cmd
 }
+
+// canonical returns the command line written to the AOF and the Raft log, it
+// does not keep the spacing or the quoting the client sent.
+func (c *Cmd) canonical() string {
+	return EncodeCmd(append([]string{c.Name}, c.Args...)...)
+}
+
+// EncodeCmd joins args into a command line that NewCmd parses back to the
+// same arguments, whatever bytes they contain.
+func EncodeCmd(args ...string) string {
+	var sb strings.Builder
+	for i, arg := range args {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(QuoteArg(arg))
+	}
+	return sb.String()
+}
+
+// QuoteArg returns arg unchanged when it needs no quoting, otherwise a double
+// quoted string with escapes.
+func QuoteArg(arg string) string {
+	if arg != "" && !needsQuote(arg) {
+		return arg
+	}
+	const hex = "0123456789abcdef"
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				sb.WriteString(`\x`)
+				sb.WriteByte(hex[c>>4])
+				sb.WriteByte(hex[c&0xf])
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func needsQuote(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		if c := arg[i]; c == '"' || c == '\'' || c < 0x20 || c == ' ' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+var (
+	errUnbalancedQuotes = errors.New("unbalanced quotes in request")
+	errQuoteNotFollowed = errors.New("closing quote must be followed by a space")
+)
+
+// splitArgs tokenizes a command line the same way redis-cli does.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		var inDouble, inSingle bool
+		for done := false; !done; {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch e := line[i]; e {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, e)
+					}
+				} else if c == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errQuoteNotFollowed
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					arg = append(arg, '\'')
+					i++
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errQuoteNotFollowed
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			i++
+		}
+		args = append(args, string(arg))
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	kvstore "github.com/zhan3333/kystore"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -13,8 +17,16 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAOF(os.Args[2:]))
+	}
+
+	// SIGINT and SIGTERM shut the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	server := kvstore.New(fmt.Sprintf("%s:%d", host, port))
-	if err := server.Run(context.Background(), &kvstore.ServerOptions{
+	if err := server.Run(ctx, &kvstore.ServerOptions{
 		Backup:         true,
 		BackupInterval: 5 * time.Second,
 		BackupType:     kvstore.BackupAOF,
@@ -24,3 +36,40 @@ func main() {
 		fmt.Println("Server stopped")
 	}
 }
+
+// checkAOF implements "check-aof [-fix] <file>", it exits with 1 when the file
+// is invalid and was not repaired.
+func checkAOF(args []string) int {
+	fs := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "truncate the file at the first invalid record")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kvstore check-aof [-fix] <file>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	result, err := kvstore.CheckAOF(fs.Arg(0), *fix)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+	if result.Err == nil {
+		fmt.Printf("AOF is valid: %d records, %d bytes\n", result.Records, result.Size)
+		return 0
+	}
+	fmt.Printf("AOF is invalid: %s\n", result.Err)
+	if result.Err.Preamble {
+		return 1
+	}
+	fmt.Printf("%d valid records, %d of %d bytes\n", result.Records, result.Valid, result.Size)
+	if !result.Fixed {
+		fmt.Printf("Run with -fix to truncate the file to %d bytes, dropping %d bytes\n", result.Valid, result.Size-result.Valid)
+		return 1
+	}
+	fmt.Printf("Truncated the file to %d bytes\n", result.Valid)
+	return 0
+}
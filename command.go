@@ -0,0 +1,123 @@
+package kvstore
+
+// commandInfo describes a command: whether it changes the keyspace and where
+// its keys are. Keys are the arguments from firstKey to lastKey every keyStep,
+// a negative lastKey counts from the end, a zero firstKey means no key.
+type commandInfo struct {
+	// write commands are logged to the AOF and proposed to the Raft log
+	write    bool
+	firstKey int
+	lastKey  int
+	keyStep  int
+}
+
+var (
+	noKeys    = commandInfo{}
+	readKey   = commandInfo{firstKey: 1, lastKey: 1, keyStep: 1}
+	writeKey  = commandInfo{write: true, firstKey: 1, lastKey: 1, keyStep: 1}
+	readKeys  = commandInfo{firstKey: 1, lastKey: -1, keyStep: 1}
+	writeKeys = commandInfo{write: true, firstKey: 1, lastKey: -1, keyStep: 1}
+	// moveKeys is a source and a destination, such as lmove source destination
+	moveKeys = commandInfo{write: true, firstKey: 1, lastKey: 2, keyStep: 1}
+)
+
+// commandTable lists the commands handleCommand serves.
+var commandTable = map[string]commandInfo{
+	"ping":         noKeys,
+	"keys":         noKeys,
+	"bgrewriteaof": noKeys,
+	"shutdown":     noKeys,
+	"get":          readKey,
+	"exists":       readKey,
+	// set key value [key value ...], the EX/PX option form is covered as well
+	"set": {write: true, firstKey: 1, lastKey: -1, keyStep: 2},
+	"del": writeKeys,
+
+	"lpush":     writeKey,
+	"rpush":     writeKey,
+	"lpop":      writeKey,
+	"rpop":      writeKey,
+	"ltrim":     writeKey,
+	"lset":      writeKey,
+	"linsert":   writeKey,
+	"lrem":      writeKey,
+	"llen":      readKey,
+	"lrange":    readKey,
+	"lindex":    readKey,
+	"lpos":      readKey,
+	"lmove":     moveKeys,
+	"rpoplpush": moveKeys,
+	// the blocking pops are run by executeBlocking as lpop, rpop and lmove
+	"blpop":  {write: true, firstKey: 1, lastKey: -2, keyStep: 1},
+	"brpop":  {write: true, firstKey: 1, lastKey: -2, keyStep: 1},
+	"blmove": moveKeys,
+
+	"sadd":      writeKey,
+	"smembers":  readKey,
+	"sismember": readKey,
+	"sscan":     readKey,
+	"srem":      writeKey,
+	"scard":     readKey,
+	// spop is logged with the seed execute adds
+	"spop":        writeKey,
+	"srandmember": readKey,
+	"smove":       moveKeys,
+	// the store variants lock the destination and the sources for writing
+	"sinter":      readKeys,
+	"sunion":      readKeys,
+	"sdiff":       readKeys,
+	"sinterstore": writeKeys,
+	"sunionstore": writeKeys,
+	"sdiffstore":  writeKeys,
+
+	"expire":    writeKey,
+	"pexpire":   writeKey,
+	"pexpireat": writeKey,
+	"persist":   writeKey,
+	// expired is internal, the Raft leader logs it to expire a key
+	"expired": writeKey,
+	"ttl":     readKey,
+	"pttl":    readKey,
+
+	"hset":    writeKey,
+	"hdel":    writeKey,
+	"hincrby": writeKey,
+	"hget":    readKey,
+	"hgetall": readKey,
+	"hkeys":   readKey,
+	"hlen":    readKey,
+
+	"zadd":          writeKey,
+	"zrem":          writeKey,
+	"zincrby":       writeKey,
+	"zscore":        readKey,
+	"zrank":         readKey,
+	"zrevrank":      readKey,
+	"zrange":        readKey,
+	"zrevrange":     readKey,
+	"zrangebyscore": readKey,
+	"zcard":         readKey,
+}
+
+// isWrite reports whether cmd changes the keyspace.
+func isWrite(cmd *Cmd) bool {
+	return commandTable[cmd.Name].write
+}
+
+// commandKeys returns the keys of cmd, unknown commands have none.
+func commandKeys(cmd *Cmd) []string {
+	info, ok := commandTable[cmd.Name]
+	if !ok || info.firstKey == 0 {
+		return nil
+	}
+	// Args do not include the command name, which is position 0
+	last := info.lastKey
+	if last < 0 {
+		last = len(cmd.Args) + 1 + last
+	}
+	var keys []string
+	for i := info.firstKey; i <= last && i <= len(cmd.Args); i += info.keyStep {
+		keys = append(keys, cmd.Args[i-1])
+	}
+	return keys
+}
@@ -0,0 +1,254 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// activeExpireInterval is how often the sweeper looks for expired keys
+	activeExpireInterval = 100 * time.Millisecond
+	// activeExpireBudget bounds the time a single sweep may take
+	activeExpireBudget = 25 * time.Millisecond
+	// activeExpireSample is the number of keys with a deadline checked per round
+	activeExpireSample = 20
+)
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// expireIfNeeded deletes key when its deadline has passed and reports whether
+// it did. The deletion is logged to the AOF, so replaying it does not depend
+// on when the replay runs. Nothing expires while expireByLog is set.
+func (s *Server) expireIfNeeded(key string) (bool, error) {
+	if s.expireByLog.Load() {
+		return false, nil
+	}
+	raw, ok := s.expires.Load(key)
+	if !ok || raw.(int64) > nowMs() {
+		return false, nil
+	}
+	if err := s.preserve(key); err != nil {
+		return false, err
+	}
+	s.expires.Delete(key)
+	if err := s.storage.Delete(key); err != nil {
+		return false, err
+	}
+	if s.aof != nil {
+		if err := s.appendAOF(EncodeCmd("del", key)); err != nil {
+			log.Printf("appand aof file failed: %s", err)
+		}
+	}
+	return true, nil
+}
+
+// proposeExpired makes the Raft leader log the expiry of the keys whose
+// deadline has passed. Only the logged expiry deletes them, on every node.
+func (s *Server) proposeExpired(keys []string) error {
+	now := nowMs()
+	for _, key := range keys {
+		raw, ok := s.expires.Load(key)
+		if !ok || raw.(int64) > now {
+			continue
+		}
+		if _, err := s.raft.propose(EncodeCmd("expired", key, strconv.FormatInt(raw.(int64), 10))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleExpired deletes key when its deadline is still at, a command run
+// since the expiry was proposed may have given it another one.
+func (s *Server) handleExpired(key string, at int64) (bool, error) {
+	raw, ok := s.expires.Load(key)
+	if !ok || raw.(int64) != at {
+		return false, nil
+	}
+	s.expires.Delete(key)
+	return true, s.storage.Delete(key)
+}
+
+// load returns the value of key, lazily expiring it.
+func (s *Server) load(key string) (any, bool, error) {
+	if expired, err := s.expireIfNeeded(key); expired || err != nil {
+		return nil, false, err
+	}
+	return s.storage.Get(key)
+}
+
+// setExpire sets the absolute deadline of an existing key in unix milliseconds.
+// A deadline in the past is kept as well, the key expires on its next access
+// or sweep like any other key.
+func (s *Server) setExpire(key string, at int64) (bool, error) {
+	if _, ok, err := s.load(key); !ok || err != nil {
+		return false, err
+	}
+	s.expires.Store(key, at)
+	return true, nil
+}
+
+// expireKey locks key and expires it when its deadline has passed, for
+// callers that are not running a command on key.
+func (s *Server) expireKey(key string) (bool, error) {
+	defer s.keyLocks.lock([]string{key}, true)()
+	return s.expireIfNeeded(key)
+}
+
+// activeExpire samples keys with a deadline and deletes the expired ones, a
+// round is repeated while more than a quarter of the sample was expired and
+// the cycle is still within its time budget. With Raft the leader proposes
+// the expiry of the keys instead, the followers wait for it.
+func (s *Server) activeExpire(ctx context.Context) {
+	t := time.NewTicker(activeExpireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if s.raft != nil && !s.raft.isLeader() {
+			continue
+		}
+		start := time.Now()
+		for time.Since(start) < activeExpireBudget {
+			sampled, expired := 0, 0
+			var proposed []string
+			now := nowMs()
+			s.cmdMu.RLock()
+			s.expires.Range(func(key, at any) bool {
+				sampled++
+				if at.(int64) > now {
+					return sampled < activeExpireSample
+				}
+				if s.raft != nil {
+					// applying the proposal takes cmdMu, it is proposed once released
+					proposed = append(proposed, key.(string))
+					expired++
+				} else if ok, err := s.expireKey(key.(string)); err != nil {
+					log.Printf("expire %s failed: %s", key, err)
+				} else if ok {
+					expired++
+				}
+				return sampled < activeExpireSample
+			})
+			s.cmdMu.RUnlock()
+			if err := s.proposeExpired(proposed); err != nil {
+				log.Printf("propose expiry failed: %s", err)
+				break
+			}
+			if expired*4 <= sampled {
+				break
+			}
+		}
+	}
+}
+
+// pastDeadline reports whether the deadline of key has passed, for reads that
+// hide keys which only expire through the log.
+func (s *Server) pastDeadline(key string) bool {
+	raw, ok := s.expires.Load(key)
+	return ok && raw.(int64) <= nowMs()
+}
+
+func (s *Server) handleTTL(key string, unit time.Duration) (int64, error) {
+	if _, ok, err := s.load(key); !ok || err != nil {
+		return -2, err
+	}
+	raw, ok := s.expires.Load(key)
+	if !ok {
+		return -1, nil
+	}
+	ms := raw.(int64) - nowMs()
+	if ms < 0 {
+		ms = 0
+	}
+	// round to the closest unit like redis does
+	return (ms + int64(unit/time.Millisecond)/2) / int64(unit/time.Millisecond), nil
+}
+
+func (s *Server) handlePersist(key string) (bool, error) {
+	if _, ok, err := s.load(key); !ok || err != nil {
+		return false, err
+	}
+	_, ok := s.expires.LoadAndDelete(key)
+	return ok, nil
+}
+
+// parseExpireAt converts an expire argument expressed in unit into a deadline
+// in unix milliseconds, a relative value is added to the current time.
+func parseExpireAt(arg string, unit time.Duration, absolute bool) (int64, error) {
+	v, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expire time: %s", arg)
+	}
+	ms := v * int64(unit/time.Millisecond)
+	if absolute {
+		return ms, nil
+	}
+	return nowMs() + ms, nil
+}
+
+// setExpireOption returns the unit and whether it is absolute for the expire
+// option of SET key value EX|PX|EXAT|PXAT time. Any other arguments are the
+// key value pairs of a multi-key SET, even when a key is named like an option.
+func setExpireOption(args []string) (unit time.Duration, absolute bool, ok bool) {
+	if len(args) != 4 {
+		return 0, false, false
+	}
+	if _, err := strconv.ParseInt(args[3], 10, 64); err != nil {
+		return 0, false, false
+	}
+	switch strings.ToLower(args[2]) {
+	case "ex":
+		return time.Second, false, true
+	case "px":
+		return time.Millisecond, false, true
+	case "exat":
+		return time.Second, true, true
+	case "pxat":
+		return time.Millisecond, true, true
+	}
+	return 0, false, false
+}
+
+// absoluteExpire rewrites commands with relative expire times into their
+// absolute form, so replaying the AOF or the Raft log sets the same deadline.
+func absoluteExpire(cmd *Cmd) (*Cmd, error) {
+	switch cmd.Name {
+	case "expire", "pexpire":
+		if len(cmd.Args) != 2 {
+			return cmd, nil
+		}
+		unit := time.Second
+		if cmd.Name == "pexpire" {
+			unit = time.Millisecond
+		}
+		at, err := parseExpireAt(cmd.Args[1], unit, false)
+		if err != nil {
+			return nil, err
+		}
+		return NewCmdArgs([]string{"pexpireat", cmd.Args[0], strconv.FormatInt(at, 10)}), nil
+	case "set":
+		unit, absolute, ok := setExpireOption(cmd.Args)
+		if !ok || (absolute && unit == time.Millisecond) {
+			return cmd, nil
+		}
+		if v, err := strconv.ParseInt(cmd.Args[3], 10, 64); err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid expire time: %s", cmd.Args[3])
+		}
+		at, err := parseExpireAt(cmd.Args[3], unit, absolute)
+		if err != nil {
+			return nil, err
+		}
+		return NewCmdArgs([]string{"set", cmd.Args[0], cmd.Args[1], "pxat", strconv.FormatInt(at, 10)}), nil
+	}
+	return cmd, nil
+}
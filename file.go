@@ -0,0 +1,48 @@
+package kvstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileSync atomically replaces path with the content produced by write:
+// the content goes to a temporary file in the same directory which is synced
+// and renamed over path, then the directory is synced so the rename survives
+// a crash. On failure path is left untouched.
+func writeFileSync(path string, write func(w io.Writer) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists the entries of dir, such as a file created or renamed in it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
@@ -0,0 +1,90 @@
+package kvstore
+
+// globMatch reports whether s matches the glob pattern: * matches any
+// sequence, ? any byte, [abc], [a-z] and [^abc] a byte of a class, and a
+// backslash escapes the next byte. On a mismatch it only backtracks to the
+// last star, which then matches one more byte, so it never recurses.
+func globMatch(pattern, s string) bool {
+	// the pattern after the last star and the input it was resumed at
+	var star, starS string
+	starred := false
+	for len(s) > 0 {
+		if len(pattern) > 0 && pattern[0] == '*' {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			star, starS, starred = pattern, s, true
+			continue
+		}
+		if len(pattern) > 0 {
+			if matched, rest := matchByte(pattern, s[0]); matched {
+				pattern, s = rest, s[1:]
+				continue
+			}
+		}
+		if !starred {
+			return false
+		}
+		starS = starS[1:]
+		pattern, s = star, starS
+	}
+	for len(pattern) > 0 && pattern[0] == '*' {
+		pattern = pattern[1:]
+	}
+	return len(pattern) == 0
+}
+
+// matchByte matches c against the first element of pattern, which is not a
+// star, and returns the pattern after it.
+func matchByte(pattern string, c byte) (bool, string) {
+	switch pattern[0] {
+	case '?':
+		return true, pattern[1:]
+	case '[':
+		return matchClass(pattern[1:], c)
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return pattern[0] == c, pattern[1:]
+}
+
+// matchClass matches c against the class at the start of pattern, which
+// follows the opening bracket, and returns the pattern after the class. A
+// class without its closing bracket runs to the end of the pattern.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			if hi == '\\' && len(pattern) > 2 {
+				hi = pattern[2]
+				pattern = pattern[1:]
+			}
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		// the closing bracket
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
@@ -0,0 +1,96 @@
+package kvstore
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type Hash struct {
+	Map map[string]string
+	sync.RWMutex
+}
+
+// Set stores field value pairs and returns the number of new fields.
+func (h *Hash) Set(fieldValues ...string) int {
+	h.Lock()
+	defer h.Unlock()
+	added := 0
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		if _, ok := h.Map[fieldValues[i]]; !ok {
+			added++
+		}
+		h.Map[fieldValues[i]] = fieldValues[i+1]
+	}
+	return added
+}
+
+func (h *Hash) Get(field string) (string, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	v, ok := h.Map[field]
+	return v, ok
+}
+
+// Del removes fields and returns the number of removed fields and the remaining length.
+func (h *Hash) Del(fields ...string) (int, int) {
+	h.Lock()
+	defer h.Unlock()
+	removed := 0
+	for _, f := range fields {
+		if _, ok := h.Map[f]; ok {
+			delete(h.Map, f)
+			removed++
+		}
+	}
+	return removed, len(h.Map)
+}
+
+func (h *Hash) IncrBy(field string, n int64) (int64, error) {
+	h.Lock()
+	defer h.Unlock()
+	var cur int64
+	if v, ok := h.Map[field]; ok {
+		var err error
+		if cur, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, errors.New("hash value is not an integer")
+		}
+	}
+	if (n > 0 && cur > math.MaxInt64-n) || (n < 0 && cur < math.MinInt64-n) {
+		return 0, errors.New("increment or decrement would overflow")
+	}
+	cur += n
+	h.Map[field] = strconv.FormatInt(cur, 10)
+	return cur, nil
+}
+
+// Fields returns the sorted field names.
+func (h *Hash) Fields() []string {
+	h.RLock()
+	defer h.RUnlock()
+	fields := make([]string, 0, len(h.Map))
+	for f := range h.Map {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// All returns a copy of the fields and values.
+func (h *Hash) All() map[string]string {
+	h.RLock()
+	defer h.RUnlock()
+	m := make(map[string]string, len(h.Map))
+	for k, v := range h.Map {
+		m[k] = v
+	}
+	return m
+}
+
+func (h *Hash) Len() int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.Map)
+}
@@ -0,0 +1,51 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+)
+
+// keyLockStripes is the number of locks keys are spread over.
+const keyLockStripes = 256
+
+// keyLocks serializes the commands on a key: keys hash to one of a fixed set
+// of locks, readers share a lock and writers hold it alone. The locks of a
+// command are taken in stripe order, so commands on several keys do not
+// deadlock.
+type keyLocks struct {
+	stripes [keyLockStripes]sync.RWMutex
+}
+
+func keyStripe(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % keyLockStripes)
+}
+
+// lock locks keys for writing when write is set, for reading otherwise, and
+// returns the function unlocking them.
+func (l *keyLocks) lock(keys []string, write bool) (unlock func()) {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, keyStripe(key))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, i := range stripes {
+		if write {
+			l.stripes[i].Lock()
+		} else {
+			l.stripes[i].RLock()
+		}
+	}
+	return func() {
+		for _, i := range stripes {
+			if write {
+				l.stripes[i].Unlock()
+			} else {
+				l.stripes[i].RUnlock()
+			}
+		}
+	}
+}
@@ -1,11 +1,306 @@
 package kvstore
 
+import "sync"
+
+// minListCap is the smallest capacity of the ring buffer of a List.
+const minListCap = 8
+
+// List is a deque kept in a ring buffer: pushes and pops at both ends are
+// amortized O(1) and indexing is O(1). The buffer doubles when it is full and
+// halves when it is less than a quarter full, so pops release memory.
 type List struct {
-	Values []string
+	buf  []string
+	head int
+	n    int
+	sync.RWMutex
+}
+
+func NewList(values ...string) *List {
+	l := &List{}
+	l.RPush(values...)
+	return l
+}
+
+// at returns the position in buf of the i-th element.
+func (l *List) at(i int) int {
+	return (l.head + i) % len(l.buf)
+}
+
+// resize moves the elements to a buffer of capacity size.
+func (l *List) resize(size int) {
+	buf := make([]string, size)
+	if l.n > 0 {
+		if l.head+l.n <= len(l.buf) {
+			copy(buf, l.buf[l.head:l.head+l.n])
+		} else {
+			k := copy(buf, l.buf[l.head:])
+			copy(buf[k:], l.buf[:l.n-k])
+		}
+	}
+	l.buf = buf
+	l.head = 0
 }
 
+func (l *List) grow() {
+	if l.n < len(l.buf) {
+		return
+	}
+	l.resize(max(len(l.buf)*2, minListCap))
+}
+
+func (l *List) shrink() {
+	if len(l.buf) > minListCap && l.n < len(l.buf)/4 {
+		l.resize(max(len(l.buf)/2, minListCap))
+	}
+}
+
+// LPush inserts values at the head one after another, so the last value ends up first.
 func (l *List) LPush(values ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, v := range values {
+		l.grow()
+		l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+		l.buf[l.head] = v
+		l.n++
+	}
+}
+
+func (l *List) RPush(values ...string) {
+	l.Lock()
+	defer l.Unlock()
 	for _, v := range values {
-		l.Values = append([]string{v}, l.Values...)
+		l.grow()
+		l.buf[l.at(l.n)] = v
+		l.n++
+	}
+}
+
+// LPop removes and returns up to n elements from the head.
+func (l *List) LPop(n int) []string {
+	l.Lock()
+	defer l.Unlock()
+	n = min(n, l.n)
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		values = append(values, l.buf[l.head])
+		l.buf[l.head] = ""
+		l.head = l.at(1)
+		l.n--
 	}
+	l.shrink()
+	return values
+}
+
+// RPop removes and returns up to n elements from the tail, the last one first.
+func (l *List) RPop(n int) []string {
+	l.Lock()
+	defer l.Unlock()
+	n = min(n, l.n)
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		tail := l.at(l.n - 1)
+		values = append(values, l.buf[tail])
+		l.buf[tail] = ""
+		l.n--
+	}
+	l.shrink()
+	return values
+}
+
+// reset replaces the elements with values.
+func (l *List) reset(values []string) {
+	l.buf, l.head, l.n = nil, 0, 0
+	if len(values) > 0 {
+		l.buf = make([]string, max(len(values), minListCap))
+		l.n = copy(l.buf, values)
+	}
+}
+
+// Set replaces the element at index, a negative index counts from the end.
+func (l *List) Set(index int, value string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if index < 0 {
+		index += l.n
+	}
+	if index < 0 || index >= l.n {
+		return false
+	}
+	l.buf[l.at(index)] = value
+	return true
+}
+
+// Insert inserts value before or after the first occurrence of pivot and
+// returns the new length, or -1 when pivot is not in the list.
+func (l *List) Insert(pivot, value string, after bool) int {
+	l.Lock()
+	defer l.Unlock()
+	for i := 0; i < l.n; i++ {
+		if l.buf[l.at(i)] != pivot {
+			continue
+		}
+		if after {
+			i++
+		}
+		values := make([]string, 0, l.n+1)
+		for j := 0; j < l.n; j++ {
+			if j == i {
+				values = append(values, value)
+			}
+			values = append(values, l.buf[l.at(j)])
+		}
+		if i == l.n {
+			values = append(values, value)
+		}
+		l.reset(values)
+		return l.n
+	}
+	return -1
+}
+
+// Rem removes the elements equal to value and returns how many were removed:
+// the first count from the head when count > 0, the last -count from the tail
+// when count < 0, all of them when count is 0.
+func (l *List) Rem(count int, value string) int {
+	l.Lock()
+	defer l.Unlock()
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	remove := make([]bool, l.n)
+	removed := 0
+	for k := 0; k < l.n && (limit == 0 || removed < limit); k++ {
+		i := k
+		if count < 0 {
+			i = l.n - 1 - k
+		}
+		if l.buf[l.at(i)] == value {
+			remove[i] = true
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	values := make([]string, 0, l.n-removed)
+	for i := 0; i < l.n; i++ {
+		if !remove[i] {
+			values = append(values, l.buf[l.at(i)])
+		}
+	}
+	l.reset(values)
+	return removed
+}
+
+// Pos returns the indexes of the elements equal to value. Matching starts at
+// the rank-th match, from the tail when rank is negative, and stops after
+// count matches, or maxLen compared elements; zero count and maxLen mean no
+// limit.
+func (l *List) Pos(value string, rank, count, maxLen int) []int {
+	l.RLock()
+	defer l.RUnlock()
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	var indexes []int
+	for k := 0; k < l.n && (maxLen == 0 || k < maxLen); k++ {
+		i := k
+		if rank < 0 {
+			i = l.n - 1 - k
+		}
+		if l.buf[l.at(i)] != value {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		indexes = append(indexes, i)
+		if count > 0 && len(indexes) == count {
+			break
+		}
+	}
+	return indexes
+}
+
+// normalizeRange converts start and stop, where negative values count from
+// the end, to the positions of a sequence of length n. ok is false when the
+// range is empty.
+func normalizeRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	if start > stop {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// Range returns a copy of the elements between start and stop, negative
+// values count from the end.
+func (l *List) Range(start, stop int) []string {
+	l.RLock()
+	defer l.RUnlock()
+	start, stop, ok := normalizeRange(start, stop, l.n)
+	if !ok {
+		return []string{}
+	}
+	values := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		values = append(values, l.buf[l.at(i)])
+	}
+	return values
+}
+
+// Trim keeps the elements between start and stop and returns the remaining length.
+func (l *List) Trim(start, stop int) int {
+	l.Lock()
+	defer l.Unlock()
+	start, stop, ok := normalizeRange(start, stop, l.n)
+	if !ok {
+		l.buf, l.head, l.n = nil, 0, 0
+		return 0
+	}
+	for i := 0; i < start; i++ {
+		l.buf[l.at(i)] = ""
+	}
+	for i := stop + 1; i < l.n; i++ {
+		l.buf[l.at(i)] = ""
+	}
+	l.head = l.at(start)
+	l.n = stop - start + 1
+	l.shrink()
+	return l.n
+}
+
+// Index returns the element at index, a negative index counts from the end.
+func (l *List) Index(index int) (string, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	if index < 0 {
+		index += l.n
+	}
+	if index < 0 || index >= l.n {
+		return "", false
+	}
+	return l.buf[l.at(index)], true
+}
+
+func (l *List) Len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.n
+}
+
+// All returns a copy of the elements.
+func (l *List) All() []string {
+	return l.Range(0, -1)
 }
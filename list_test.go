@@ -0,0 +1,210 @@
+package kvstore_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	kvstore "github.com/zhan3333/kystore"
+)
+
+// newWrappedList returns the list a to h in a full ring buffer of 8 whose
+// end falls between d and e.
+func newWrappedList() *kvstore.List {
+	l := kvstore.NewList("_", "_", "_", "_")
+	l.LPop(4)
+	l.RPush("a", "b", "c", "d", "e", "f", "g", "h")
+	return l
+}
+
+func TestListWraparound(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(l *kvstore.List)
+		want []string
+	}{
+		{"wrapped", func(l *kvstore.List) {}, []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+		{"lpush grows", func(l *kvstore.List) { l.LPush("y", "z") }, []string{"z", "y", "a", "b", "c", "d", "e", "f", "g", "h"}},
+		{"rpush grows", func(l *kvstore.List) { l.RPush("y", "z") }, []string{"a", "b", "c", "d", "e", "f", "g", "h", "y", "z"}},
+		{"lpop across the end", func(l *kvstore.List) { l.LPop(5) }, []string{"f", "g", "h"}},
+		{"rpop across the end", func(l *kvstore.List) { l.RPop(5) }, []string{"a", "b", "c"}},
+		{"pop then push at both ends", func(l *kvstore.List) {
+			l.RPop(2)
+			l.LPop(2)
+			l.RPush("y")
+			l.LPush("z")
+		}, []string{"z", "c", "d", "e", "f", "y"}},
+		{"pop all", func(l *kvstore.List) { l.LPop(10) }, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newWrappedList()
+			tt.op(l)
+			assert.Equal(t, tt.want, l.All())
+			assert.Equal(t, len(tt.want), l.Len())
+			for i, v := range tt.want {
+				val, ok := l.Index(i)
+				assert.True(t, ok)
+				assert.Equal(t, v, val)
+			}
+		})
+	}
+}
+
+func TestListGrowShrink(t *testing.T) {
+	// the buffer grows and shrinks many times on the way up and down, the
+	// elements keep their order through every copy
+	l := kvstore.NewList()
+	var want []string
+	for i := 0; i < 1000; i++ {
+		v := strconv.Itoa(i)
+		if i%2 == 0 {
+			l.LPush(v)
+			want = append([]string{v}, want...)
+		} else {
+			l.RPush(v)
+			want = append(want, v)
+		}
+	}
+	assert.Equal(t, want, l.All())
+	for len(want) > 3 {
+		assert.Equal(t, want[:2], l.LPop(2))
+		want = want[2:]
+		assert.Equal(t, []string{want[len(want)-1]}, l.RPop(1))
+		want = want[:len(want)-1]
+		assert.Equal(t, want, l.All())
+	}
+	l.RPush("x")
+	assert.Equal(t, append(want, "x"), l.All())
+}
+
+func TestListRangeTrim(t *testing.T) {
+	tests := []struct {
+		start, stop int
+		want        []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+		{2, 5, []string{"c", "d", "e", "f"}},
+		{-5, -3, []string{"d", "e", "f"}},
+		{-100, 1, []string{"a", "b"}},
+		{6, 100, []string{"g", "h"}},
+		{-1, -1, []string{"h"}},
+		{5, 2, []string{}},
+		{8, 10, []string{}},
+		{-100, -9, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d..%d", tt.start, tt.stop), func(t *testing.T) {
+			l := newWrappedList()
+			assert.Equal(t, tt.want, l.Range(tt.start, tt.stop))
+			assert.Equal(t, len(tt.want), l.Trim(tt.start, tt.stop))
+			assert.Equal(t, tt.want, l.All())
+			// the trimmed list keeps working
+			l.LPush("y")
+			l.RPush("z")
+			assert.Equal(t, append(append([]string{"y"}, tt.want...), "z"), l.All())
+		})
+	}
+}
+
+func TestListInsertRem(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(l *kvstore.List) int
+		ret  int
+		want []string
+	}{
+		{"insert before the end", func(l *kvstore.List) int { return l.Insert("e", "x", false) }, 9,
+			[]string{"a", "b", "c", "d", "x", "e", "f", "g", "h"}},
+		{"insert after the end", func(l *kvstore.List) int { return l.Insert("d", "x", true) }, 9,
+			[]string{"a", "b", "c", "d", "x", "e", "f", "g", "h"}},
+		{"insert after the tail", func(l *kvstore.List) int { return l.Insert("h", "x", true) }, 9,
+			[]string{"a", "b", "c", "d", "e", "f", "g", "h", "x"}},
+		{"insert missing pivot", func(l *kvstore.List) int { return l.Insert("x", "y", true) }, -1,
+			[]string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+		{"rem across the end", func(l *kvstore.List) int {
+			l.Set(2, "x")
+			l.Set(-3, "x")
+			return l.Rem(0, "x")
+		}, 2, []string{"a", "b", "d", "e", "g", "h"}},
+		{"rem from the head", func(l *kvstore.List) int {
+			l.Set(3, "x")
+			l.Set(4, "x")
+			l.Set(-1, "x")
+			return l.Rem(2, "x")
+		}, 2, []string{"a", "b", "c", "f", "g", "x"}},
+		{"rem from the tail", func(l *kvstore.List) int {
+			l.Set(0, "x")
+			l.Set(3, "x")
+			l.Set(4, "x")
+			return l.Rem(-2, "x")
+		}, 2, []string{"x", "b", "c", "f", "g", "h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newWrappedList()
+			assert.Equal(t, tt.ret, tt.op(l))
+			assert.Equal(t, tt.want, l.All())
+			l.RPush("z")
+			assert.Equal(t, append(tt.want, "z"), l.All())
+		})
+	}
+}
+
+// The list benchmarks run every operation on lists of growing sizes, the time
+// per operation stays flat since the ends of the deque are O(1).
+var listBenchSizes = []int{1_000, 10_000, 100_000}
+
+func newBenchList(size int) *kvstore.List {
+	l := kvstore.NewList()
+	for i := 0; i < size; i++ {
+		l.RPush("value")
+	}
+	return l
+}
+
+func BenchmarkListLPush(b *testing.B) {
+	for _, size := range listBenchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			l := newBenchList(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.LPush("value")
+				l.LPop(1)
+			}
+		})
+	}
+}
+
+func BenchmarkListRPush(b *testing.B) {
+	l := kvstore.NewList()
+	for i := 0; i < b.N; i++ {
+		l.RPush("value")
+	}
+}
+
+func BenchmarkListLPop(b *testing.B) {
+	for _, size := range listBenchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			l := newBenchList(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.LPop(1)
+				l.RPush("value")
+			}
+		})
+	}
+}
+
+func BenchmarkListIndex(b *testing.B) {
+	for _, size := range listBenchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			l := newBenchList(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.Index(i % size)
+			}
+		})
+	}
+}
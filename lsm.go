@@ -0,0 +1,567 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultLSMMemtableSize = 4 * 1024 * 1024
+	defaultLSMMaxSegments  = 4
+	// lsmIndexInterval is the number of records between two keys of the
+	// in-memory index of a segment
+	lsmIndexInterval = 16
+)
+
+// A segment is a sequence of records sorted by key. A record is the uvarint
+// prefixed key, lsmOpPut followed by the uvarint prefixed encoded value, or
+// lsmOpDelete.
+const (
+	lsmOpPut byte = iota
+	lsmOpDelete
+)
+
+const (
+	lsmSegmentPattern = "segment-*.seg"
+	lsmSegmentFormat  = "segment-%06d.seg"
+	// a segment is written to a temporary file renamed once complete
+	lsmTempSuffix = ".tmp"
+)
+
+type LSMOptions struct {
+	// MemtableSize is the size of the keys and encoded values kept in memory
+	// before they are written to a segment, defaults to 4MB
+	MemtableSize int
+	// MaxSegments is the number of segments above which they are merged,
+	// defaults to 4
+	MaxSegments int
+}
+
+// LSMStorage keeps the keyspace on disk as a log structured merge tree.
+// Writes go to a memtable of encoded values, which is written to an immutable
+// segment file sorted by key once it outgrows MemtableSize. A read looks at
+// the memtable, then at the segments from the newest to the oldest. Once
+// there are more than MaxSegments segments they are merged into one in the
+// background, dropping overwritten values and deletions.
+//
+// Only every lsmIndexInterval-th key of a segment is kept in memory. Values
+// are stored whole, so every change of a collection writes all of it again.
+//
+// Opening the storage loads the segments left in dir by a previous run and
+// Close flushes the memtable, so the keys survive a clean restart. The
+// memtable is lost on a crash and the deadlines are kept by the server, so
+// with a backup or Raft the server rebuilds the keyspace from them instead.
+type LSMStorage struct {
+	dir     string
+	options LSMOptions
+
+	mu sync.RWMutex
+	// memtable maps keys to their encoded value, nil for a deleted key
+	memtable     map[string][]byte
+	memtableSize int
+	// segments are ordered from the newest to the oldest
+	segments   []*lsmSegment
+	seq        int
+	compacting bool
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// lsmRecord is a record of a segment, value is nil for a deletion.
+type lsmRecord struct {
+	key   string
+	value []byte
+}
+
+type lsmIndexEntry struct {
+	key    string
+	offset int64
+}
+
+type lsmSegment struct {
+	path  string
+	f     *os.File
+	size  int64
+	index []lsmIndexEntry
+}
+
+// OpenLSMStorage opens the storage kept in dir, creating dir when it does
+// not exist, and loads its segments.
+func OpenLSMStorage(dir string, options *LSMOptions) (*LSMStorage, error) {
+	l := &LSMStorage{dir: dir, memtable: map[string][]byte{}}
+	if options != nil {
+		l.options = *options
+	}
+	if l.options.MemtableSize <= 0 {
+		l.options.MemtableSize = defaultLSMMemtableSize
+	}
+	if l.options.MaxSegments < 1 {
+		l.options.MaxSegments = defaultLSMMaxSegments
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// a segment left incomplete by a crash was never used
+	temps, err := filepath.Glob(filepath.Join(dir, lsmSegmentPattern+lsmTempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range temps {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, lsmSegmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	seqs := map[string]int{}
+	for _, path := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), lsmSegmentFormat, &seq); err != nil {
+			return nil, fmt.Errorf("invalid segment name %s", path)
+		}
+		seqs[path] = seq
+		l.seq = max(l.seq, seq)
+	}
+	// newest first
+	sort.Slice(paths, func(i, j int) bool { return seqs[paths[i]] > seqs[paths[j]] })
+	for _, path := range paths {
+		sg, err := openLSMSegment(path)
+		if err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("open %s failed: %w", path, err)
+		}
+		l.segments = append(l.segments, sg)
+	}
+	return l, nil
+}
+
+func (l *LSMStorage) Get(key string) (any, bool, error) {
+	l.mu.RLock()
+	b, ok, err := l.get(key)
+	l.mu.RUnlock()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	v, err := decodeValue(b)
+	if err != nil {
+		return nil, false, fmt.Errorf("decode %s failed: %w", key, err)
+	}
+	return v, true, nil
+}
+
+func (l *LSMStorage) get(key string) ([]byte, bool, error) {
+	if l.closed {
+		return nil, false, errStorageClosed
+	}
+	if b, ok := l.memtable[key]; ok {
+		return b, b != nil, nil
+	}
+	for _, sg := range l.segments {
+		b, ok, err := sg.get(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("read %s failed: %w", sg.path, err)
+		}
+		if ok {
+			return b, b != nil, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (l *LSMStorage) Put(key string, value any) error {
+	b, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+	return l.write(key, b)
+}
+
+func (l *LSMStorage) Delete(key string) error {
+	return l.write(key, nil)
+}
+
+func (l *LSMStorage) write(key string, b []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errStorageClosed
+	}
+	if old, ok := l.memtable[key]; ok {
+		l.memtableSize -= len(key) + len(old)
+	}
+	l.memtable[key] = b
+	l.memtableSize += len(key) + len(b)
+	if l.memtableSize < l.options.MemtableSize {
+		return nil
+	}
+	return l.flush()
+}
+
+// flush writes the memtable to a new segment and starts a compaction when
+// there are too many segments.
+func (l *LSMStorage) flush() error {
+	keys := make([]string, 0, len(l.memtable))
+	for key := range l.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	i := 0
+	sg, err := writeLSMSegment(l.nextSegmentPath(), func() (lsmRecord, bool) {
+		if i == len(keys) {
+			return lsmRecord{}, false
+		}
+		i++
+		return lsmRecord{key: keys[i-1], value: l.memtable[keys[i-1]]}, true
+	})
+	if err != nil {
+		return fmt.Errorf("flush memtable failed: %w", err)
+	}
+	l.segments = append([]*lsmSegment{sg}, l.segments...)
+	l.memtable = map[string][]byte{}
+	l.memtableSize = 0
+	if len(l.segments) > l.options.MaxSegments && !l.compacting && !l.closed {
+		l.compacting = true
+		l.wg.Add(1)
+		go l.compact()
+	}
+	return nil
+}
+
+func (l *LSMStorage) nextSegmentPath() string {
+	l.seq++
+	return filepath.Join(l.dir, fmt.Sprintf(lsmSegmentFormat, l.seq))
+}
+
+// compact merges the current segments into one. The segments flushed
+// meanwhile are newer, so they stay in front of the merged one.
+func (l *LSMStorage) compact() {
+	defer l.wg.Done()
+	l.mu.Lock()
+	inputs := slices.Clone(l.segments)
+	path := l.nextSegmentPath()
+	l.mu.Unlock()
+
+	merged, err := mergeLSMSegments(path, inputs)
+
+	l.mu.Lock()
+	l.compacting = false
+	if err != nil {
+		l.mu.Unlock()
+		log.Printf("compact segments failed: %s", err)
+		return
+	}
+	l.segments = append(l.segments[:len(l.segments)-len(inputs)], merged)
+	l.mu.Unlock()
+
+	for _, sg := range inputs {
+		if err := sg.remove(); err != nil {
+			log.Printf("remove segment %s failed: %s", sg.path, err)
+		}
+	}
+}
+
+// mergeLSMSegments writes the newest record of every key of segments, which
+// are ordered from the newest to the oldest. Since the oldest segment is
+// merged as well, deletions are dropped.
+func mergeLSMSegments(path string, segments []*lsmSegment) (*lsmSegment, error) {
+	iters := make([]*lsmIterator, 0, len(segments))
+	for _, sg := range segments {
+		it := sg.iter()
+		it.next()
+		iters = append(iters, it)
+	}
+	next := func() (lsmRecord, bool) {
+		for {
+			var newest *lsmIterator
+			for _, it := range iters {
+				if !it.done && (newest == nil || it.rec.key < newest.rec.key) {
+					newest = it
+				}
+			}
+			if newest == nil {
+				return lsmRecord{}, false
+			}
+			rec := newest.rec
+			for _, it := range iters {
+				if !it.done && it.rec.key == rec.key {
+					it.next()
+				}
+			}
+			if rec.value != nil {
+				return rec, true
+			}
+		}
+	}
+	sg, err := writeLSMSegment(path, next)
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range iters {
+		if it.err != nil {
+			_ = sg.remove()
+			return nil, it.err
+		}
+	}
+	return sg, nil
+}
+
+// Scan collects the live keys first, so fn may use the storage.
+func (l *LSMStorage) Scan(fn func(key string) bool) error {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return errStorageClosed
+	}
+	live := map[string]bool{}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		it := l.segments[i].iter()
+		for it.next() {
+			live[it.rec.key] = it.rec.value != nil
+		}
+		if it.err != nil {
+			l.mu.RUnlock()
+			return fmt.Errorf("read %s failed: %w", l.segments[i].path, it.err)
+		}
+	}
+	for key, b := range l.memtable {
+		live[key] = b != nil
+	}
+	l.mu.RUnlock()
+
+	keys := make([]string, 0, len(live))
+	for key, ok := range live {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close flushes the memtable, waits for a running compaction and closes the
+// segments.
+func (l *LSMStorage) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	var err error
+	if len(l.memtable) > 0 {
+		err = l.flush()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	for _, sg := range l.segments {
+		if closeErr := sg.f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writeLSMSegment writes the records returned by next, which are sorted by key.
+// The segment only appears at path once it is complete and synced.
+func writeLSMSegment(path string, next func() (lsmRecord, bool)) (*lsmSegment, error) {
+	f, err := os.OpenFile(path+lsmTempSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sg := &lsmSegment{path: path + lsmTempSuffix, f: f}
+	w := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		_, _ = w.Write(buf[:n])
+		_, _ = w.Write(b)
+		sg.size += int64(n + len(b))
+	}
+	for n := 0; ; n++ {
+		rec, ok := next()
+		if !ok {
+			break
+		}
+		if n%lsmIndexInterval == 0 {
+			sg.index = append(sg.index, lsmIndexEntry{key: rec.key, offset: sg.size})
+		}
+		writeBytes([]byte(rec.key))
+		if rec.value == nil {
+			_ = w.WriteByte(lsmOpDelete)
+			sg.size++
+			continue
+		}
+		_ = w.WriteByte(lsmOpPut)
+		sg.size++
+		writeBytes(rec.value)
+	}
+	if err := w.Flush(); err != nil {
+		_ = sg.remove()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = sg.remove()
+		return nil, err
+	}
+	if err := os.Rename(sg.path, path); err != nil {
+		_ = sg.remove()
+		return nil, err
+	}
+	sg.path = path
+	return sg, nil
+}
+
+// openLSMSegment opens a segment written by a previous run and rebuilds its
+// index.
+func openLSMSegment(path string) (*lsmSegment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	sg := &lsmSegment{path: path, f: f, size: info.Size()}
+	sr := io.NewSectionReader(f, 0, sg.size)
+	r := bufio.NewReader(sr)
+	for n := 0; ; n++ {
+		read, _ := sr.Seek(0, io.SeekCurrent)
+		offset := read - int64(r.Buffered())
+		rec, err := readLSMRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if n%lsmIndexInterval == 0 {
+			sg.index = append(sg.index, lsmIndexEntry{key: rec.key, offset: offset})
+		}
+	}
+	return sg, nil
+}
+
+// get returns the value of key, ok is set when the segment has a record of
+// key, value is nil when the record is a deletion.
+func (sg *lsmSegment) get(key string) (value []byte, ok bool, err error) {
+	i := sort.Search(len(sg.index), func(i int) bool { return sg.index[i].key > key }) - 1
+	if i < 0 {
+		return nil, false, nil
+	}
+	end := sg.size
+	if i+1 < len(sg.index) {
+		end = sg.index[i+1].offset
+	}
+	block := make([]byte, end-sg.index[i].offset)
+	if _, err := sg.f.ReadAt(block, sg.index[i].offset); err != nil {
+		return nil, false, err
+	}
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		rec, err := readLSMRecord(r)
+		if err != nil {
+			return nil, false, err
+		}
+		if rec.key == key {
+			return rec.value, true, nil
+		}
+		if rec.key > key {
+			break
+		}
+	}
+	return nil, false, nil
+}
+
+func (sg *lsmSegment) remove() error {
+	_ = sg.f.Close()
+	return os.Remove(sg.path)
+}
+
+type lsmIterator struct {
+	r    *bufio.Reader
+	rec  lsmRecord
+	done bool
+	err  error
+}
+
+func (sg *lsmSegment) iter() *lsmIterator {
+	return &lsmIterator{r: bufio.NewReader(io.NewSectionReader(sg.f, 0, sg.size))}
+}
+
+// next moves to the next record and reports whether there is one.
+func (it *lsmIterator) next() bool {
+	if it.done {
+		return false
+	}
+	rec, err := readLSMRecord(it.r)
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.done = true
+		return false
+	}
+	it.rec = rec
+	return true
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readLSMRecord(r byteReader) (lsmRecord, error) {
+	key, err := readLSMBytes(r)
+	if err != nil {
+		return lsmRecord{}, err
+	}
+	op, err := r.ReadByte()
+	if err != nil {
+		return lsmRecord{}, io.ErrUnexpectedEOF
+	}
+	rec := lsmRecord{key: string(key)}
+	switch op {
+	case lsmOpDelete:
+		return rec, nil
+	case lsmOpPut:
+		if rec.value, err = readLSMBytes(r); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rec, err
+	}
+	return lsmRecord{}, fmt.Errorf("invalid segment record of %s", rec.key)
+}
+
+func readLSMBytes(r byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > rdbMaxLen {
+		return nil, fmt.Errorf("invalid segment record length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
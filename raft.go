@@ -0,0 +1,823 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RaftOptions enables Raft replication. Every mutating command is appended to
+// the replicated log and only applied once a majority of the group stored it.
+// The log is not compacted: it keeps every command since the group started,
+// a restarted node replays all of it, and Server.RaftStats reports its size.
+type RaftOptions struct {
+	// Addr is the address the Raft RPC endpoint listens on, it also identifies the node
+	Addr string
+	// Peers are the Raft addresses of the other nodes in the group
+	Peers []string
+	// DataDir keeps the persistent term, vote and log
+	DataDir string
+	// ElectionTimeout is randomized between ElectionTimeout and 2*ElectionTimeout
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is the interval the leader sends AppendEntries at
+	HeartbeatInterval time.Duration
+}
+
+// RaftEntry is a replicated log entry, an empty Command is the no-op a new
+// leader appends to commit the entries of previous terms.
+type RaftEntry struct {
+	Term    int
+	Command string
+}
+
+// RaftStats describes a Raft node, the log only grows since it is not compacted.
+type RaftStats struct {
+	Leader      bool
+	Term        int
+	CommitIndex int
+	LastApplied int
+	// LogEntries and LogBytes are the size of the log in entries and in bytes
+	// of raft-log.json, the no-ops appended by new leaders included
+	LogEntries int
+	LogBytes   int64
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term             int
+	LeaderID         string
+	LeaderClientAddr string
+	PrevLogIndex     int
+	PrevLogTerm      int
+	Entries          []RaftEntry
+	LeaderCommit     int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// ConflictIndex is where the leader retries from when Success is false
+	ConflictIndex int
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+var (
+	errRaftStopped  = errors.New("raft stopped")
+	errRaftTimeout  = errors.New("raft request timed out")
+	errRaftLostLead = errors.New("leadership lost before the command was committed")
+)
+
+type raftResult struct {
+	resp any
+	err  error
+}
+
+type raftWaiter struct {
+	term int
+	ch   chan raftResult
+}
+
+type raftNode struct {
+	mu sync.Mutex
+
+	id                string
+	clientAddr        string
+	peers             []string
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	storage           *raftStorage
+	apply             func(cmd string) (any, error)
+	applyCond         *sync.Cond
+
+	role     raftRole
+	term     int
+	votedFor string
+	// log[0] is a sentinel so that Raft indexes are slice indexes
+	log              []RaftEntry
+	commitIndex      int
+	lastApplied      int
+	leaderAddr       string
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	nextIndex        map[string]int
+	matchIndex       map[string]int
+	replicating      map[string]bool
+	waiters          map[int]*raftWaiter
+	stopped          bool
+
+	listener  net.Listener
+	connsMu   sync.Mutex
+	conns     map[net.Conn]struct{}
+	clientsMu sync.Mutex
+	clients   map[string]*rpc.Client
+	done      chan struct{}
+}
+
+func newRaftNode(clientAddr string, options *RaftOptions, apply func(cmd string) (any, error)) (*raftNode, error) {
+	if options.Addr == "" {
+		return nil, errors.New("raft addr is required")
+	}
+	if options.DataDir == "" {
+		options.DataDir = "."
+	}
+	if options.ElectionTimeout <= 0 {
+		options.ElectionTimeout = 300 * time.Millisecond
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = 50 * time.Millisecond
+	}
+	storage, state, entries, err := openRaftStorage(options.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	n := &raftNode{
+		id:                options.Addr,
+		clientAddr:        clientAddr,
+		peers:             options.Peers,
+		electionTimeout:   options.ElectionTimeout,
+		heartbeatInterval: options.HeartbeatInterval,
+		storage:           storage,
+		apply:             apply,
+		term:              state.Term,
+		votedFor:          state.VotedFor,
+		log:               append([]RaftEntry{{}}, entries...),
+		nextIndex:         map[string]int{},
+		matchIndex:        map[string]int{},
+		replicating:       map[string]bool{},
+		waiters:           map[int]*raftWaiter{},
+		conns:             map[net.Conn]struct{}{},
+		clients:           map[string]*rpc.Client{},
+		done:              make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionDeadline()
+	return n, nil
+}
+
+func (n *raftNode) start() error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &raftRPC{n: n}); err != nil {
+		return fmt.Errorf("register raft rpc failed: %w", err)
+	}
+	listener, err := net.Listen("tcp", n.id)
+	if err != nil {
+		return fmt.Errorf("raft listen failed: %w", err)
+	}
+	n.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.connsMu.Lock()
+			n.conns[conn] = struct{}{}
+			n.connsMu.Unlock()
+			go func() {
+				srv.ServeConn(conn)
+				n.connsMu.Lock()
+				delete(n.conns, conn)
+				n.connsMu.Unlock()
+			}()
+		}
+	}()
+	go n.run()
+	go n.applyLoop()
+	log.Printf("Raft node %s started with %d peers", n.id, len(n.peers))
+	return nil
+}
+
+func (n *raftNode) stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.done)
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+
+	_ = n.listener.Close()
+	n.connsMu.Lock()
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	n.connsMu.Unlock()
+	n.clientsMu.Lock()
+	for peer, c := range n.clients {
+		_ = c.Close()
+		delete(n.clients, peer)
+	}
+	n.clientsMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.storage.close(); err != nil {
+		log.Printf("close raft storage failed: %s", err)
+	}
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == raftLeader
+}
+
+func (n *raftNode) stats() RaftStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return RaftStats{
+		Leader:      n.role == raftLeader,
+		Term:        n.term,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LogEntries:  len(n.log) - 1,
+		LogBytes:    n.storage.size,
+	}
+}
+
+// propose appends cmd to the log and waits until it is applied, returning the
+// result of the state machine.
+func (n *raftNode) propose(cmd string) (any, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, errRaftStopped
+	}
+	if n.role != raftLeader {
+		leader := n.leaderAddr
+		n.mu.Unlock()
+		if leader == "" {
+			return nil, errors.New("not leader, leader unknown")
+		}
+		return nil, fmt.Errorf("not leader, leader is %s", leader)
+	}
+	entry := RaftEntry{Term: n.term, Command: cmd}
+	if err := n.storage.append([]RaftEntry{entry}); err != nil {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("persist raft log failed: %w", err)
+	}
+	n.log = append(n.log, entry)
+	index := len(n.log) - 1
+	w := &raftWaiter{term: n.term, ch: make(chan raftResult, 1)}
+	n.waiters[index] = w
+	n.advanceCommit()
+	n.broadcast()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(10 * n.electionTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-w.ch:
+		return res.resp, res.err
+	case <-n.done:
+		return nil, errRaftStopped
+	case <-timer.C:
+		n.mu.Lock()
+		if n.waiters[index] == w {
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+		return nil, errRaftTimeout
+	}
+}
+
+func (n *raftNode) run() {
+	t := time.NewTicker(n.heartbeatInterval / 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		if n.role == raftLeader {
+			if time.Since(n.lastBroadcast) >= n.heartbeatInterval {
+				n.broadcast()
+			}
+		} else if time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *raftNode) applyLoop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for n.lastApplied >= n.commitIndex && !n.stopped {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		index := n.lastApplied + 1
+		entry := n.log[index]
+		n.mu.Unlock()
+		var res raftResult
+		if entry.Command != "" {
+			res.resp, res.err = n.apply(entry.Command)
+		}
+		n.mu.Lock()
+		n.lastApplied = index
+		if w, ok := n.waiters[index]; ok {
+			delete(n.waiters, index)
+			if w.term != entry.Term {
+				res = raftResult{err: errRaftLostLead}
+			}
+			w.ch <- res
+		}
+	}
+}
+
+func (n *raftNode) resetElectionDeadline() {
+	timeout := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *raftNode) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *raftNode) persistState() error {
+	return n.storage.saveState(raftHardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+func (n *raftNode) becomeFollower(term int) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persistState(); err != nil {
+			log.Printf("persist raft state failed: %s", err)
+		}
+	}
+	n.role = raftFollower
+}
+
+func (n *raftNode) startElection() {
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leaderAddr = ""
+	if err := n.persistState(); err != nil {
+		log.Printf("persist raft state failed: %s", err)
+	}
+	n.resetElectionDeadline()
+
+	term := n.term
+	args := &RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: len(n.log) - 1,
+		LastLogTerm:  n.log[len(n.log)-1].Term,
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			var reply RequestVoteReply
+			if err := n.call(peer, "Raft.RequestVote", args, &reply); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.stopped {
+				return
+			}
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != raftCandidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (n *raftNode) becomeLeader() {
+	n.role = raftLeader
+	n.leaderAddr = n.clientAddr
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = len(n.log)
+		n.matchIndex[peer] = 0
+	}
+	log.Printf("Raft node %s became leader of term %d", n.id, n.term)
+	// a no-op entry of the new term commits the entries left by previous leaders
+	entry := RaftEntry{Term: n.term}
+	if err := n.storage.append([]RaftEntry{entry}); err != nil {
+		log.Printf("persist raft log failed: %s", err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.log = append(n.log, entry)
+	n.advanceCommit()
+	n.broadcast()
+}
+
+func (n *raftNode) broadcast() {
+	n.lastBroadcast = time.Now()
+	for _, peer := range n.peers {
+		if !n.replicating[peer] {
+			n.replicating[peer] = true
+			go n.replicateTo(peer)
+		}
+	}
+}
+
+// replicateTo sends AppendEntries to peer until it has caught up with the log.
+func (n *raftNode) replicateTo(peer string) {
+	n.mu.Lock()
+	defer func() {
+		n.replicating[peer] = false
+		n.mu.Unlock()
+	}()
+	for n.role == raftLeader && !n.stopped {
+		term := n.term
+		prev := n.nextIndex[peer] - 1
+		args := &AppendEntriesArgs{
+			Term:             term,
+			LeaderID:         n.id,
+			LeaderClientAddr: n.clientAddr,
+			PrevLogIndex:     prev,
+			PrevLogTerm:      n.log[prev].Term,
+			Entries:          append([]RaftEntry(nil), n.log[prev+1:]...),
+			LeaderCommit:     n.commitIndex,
+		}
+		n.mu.Unlock()
+		var reply AppendEntriesReply
+		err := n.call(peer, "Raft.AppendEntries", args, &reply)
+		n.mu.Lock()
+		if err != nil {
+			return
+		}
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term)
+			return
+		}
+		if n.role != raftLeader || n.term != term {
+			return
+		}
+		if !reply.Success {
+			next := reply.ConflictIndex
+			if next < 1 {
+				next = 1
+			}
+			if next > len(n.log) {
+				next = len(n.log)
+			}
+			n.nextIndex[peer] = next
+			continue
+		}
+		if match := prev + len(args.Entries); match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		if n.nextIndex[peer] >= len(n.log) {
+			return
+		}
+	}
+}
+
+// advanceCommit commits the highest entry of the current term stored on a majority.
+func (n *raftNode) advanceCommit() {
+	for index := len(n.log) - 1; index > n.commitIndex; index-- {
+		if n.log[index].Term != n.term {
+			return
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *raftNode) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return errRaftStopped
+	}
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	lastIndex := len(n.log) - 1
+	lastTerm := n.log[lastIndex].Term
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		if err := n.persistState(); err != nil {
+			return err
+		}
+		reply.VoteGranted = true
+		n.resetElectionDeadline()
+	}
+	return nil
+}
+
+func (n *raftNode) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return errRaftStopped
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	n.becomeFollower(args.Term)
+	n.leaderAddr = args.LeaderClientAddr
+	n.resetElectionDeadline()
+	reply.Term = n.term
+
+	if args.PrevLogIndex >= len(n.log) {
+		reply.ConflictIndex = len(n.log)
+		return nil
+	}
+	if term := n.log[args.PrevLogIndex].Term; term != args.PrevLogTerm {
+		index := args.PrevLogIndex
+		for index > 1 && n.log[index-1].Term == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return nil
+	}
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index < len(n.log) {
+			if n.log[index].Term == entry.Term {
+				continue
+			}
+			n.log = append(n.log[:index:index], args.Entries[i:]...)
+			if err := n.storage.rewrite(n.log[1:]); err != nil {
+				return err
+			}
+			break
+		}
+		if err := n.storage.append(args.Entries[i:]); err != nil {
+			return err
+		}
+		n.log = append(n.log, args.Entries[i:]...)
+		break
+	}
+	reply.Success = true
+
+	if args.LeaderCommit > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if last := args.PrevLogIndex + len(args.Entries); last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.applyCond.Broadcast()
+	}
+	return nil
+}
+
+func (n *raftNode) call(peer string, method string, args any, reply any) error {
+	c, err := n.client(peer)
+	if err != nil {
+		return err
+	}
+	call := c.Go(method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(n.electionTimeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			if _, ok := call.Error.(rpc.ServerError); !ok {
+				n.dropClient(peer, c)
+			}
+		}
+		return call.Error
+	case <-timer.C:
+		n.dropClient(peer, c)
+		return errRaftTimeout
+	case <-n.done:
+		return errRaftStopped
+	}
+}
+
+func (n *raftNode) client(peer string) (*rpc.Client, error) {
+	n.clientsMu.Lock()
+	defer n.clientsMu.Unlock()
+	if c, ok := n.clients[peer]; ok {
+		return c, nil
+	}
+	conn, err := net.DialTimeout("tcp", peer, n.electionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := rpc.NewClient(conn)
+	n.clients[peer] = c
+	return c, nil
+}
+
+func (n *raftNode) dropClient(peer string, c *rpc.Client) {
+	n.clientsMu.Lock()
+	defer n.clientsMu.Unlock()
+	if n.clients[peer] == c {
+		delete(n.clients, peer)
+	}
+	_ = c.Close()
+}
+
+// raftRPC exposes the Raft handlers to net/rpc.
+type raftRPC struct {
+	n *raftNode
+}
+
+func (r *raftRPC) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return r.n.handleRequestVote(args, reply)
+}
+
+func (r *raftRPC) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return r.n.handleAppendEntries(args, reply)
+}
+
+/* persistent storage */
+
+type raftHardState struct {
+	Term     int    `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// raftStorage keeps the hard state in raft-state.json and the log as one JSON
+// entry per line in raft-log.json. There is no snapshot of the state machine,
+// so the log is never truncated.
+type raftStorage struct {
+	dir     string
+	logFile *os.File
+	// size is the size of raft-log.json
+	size int64
+}
+
+func openRaftStorage(dir string) (*raftStorage, raftHardState, []RaftEntry, error) {
+	var state raftHardState
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, state, nil, fmt.Errorf("create raft dir failed: %w", err)
+	}
+	rs := &raftStorage{dir: dir}
+
+	b, err := os.ReadFile(rs.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state, nil, fmt.Errorf("read raft state failed: %w", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return nil, state, nil, fmt.Errorf("unmarshal raft state failed: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(rs.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, state, nil, fmt.Errorf("open raft log failed: %w", err)
+	}
+	rs.logFile = f
+
+	var entries []RaftEntry
+	torn := false
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, state, nil, fmt.Errorf("read raft log failed: %w", err)
+		}
+		if len(line) > 0 {
+			var entry RaftEntry
+			if line[len(line)-1] != '\n' || json.Unmarshal(line, &entry) != nil {
+				// an entry is only acknowledged after fsync, so a torn tail is safe to drop
+				torn = true
+				break
+			}
+			entries = append(entries, entry)
+			rs.size += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if torn {
+		log.Printf("Raft log has a torn tail, keeping %d entries", len(entries))
+		if err := rs.rewrite(entries); err != nil {
+			return nil, state, nil, err
+		}
+	}
+	return rs, state, entries, nil
+}
+
+func (rs *raftStorage) statePath() string {
+	return filepath.Join(rs.dir, "raft-state.json")
+}
+
+func (rs *raftStorage) logPath() string {
+	return filepath.Join(rs.dir, "raft-log.json")
+}
+
+func (rs *raftStorage) saveState(state raftHardState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal raft state failed: %w", err)
+	}
+	return writeFileSync(rs.statePath(), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+func (rs *raftStorage) append(entries []RaftEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("marshal raft entry failed: %w", err)
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	n, err := rs.logFile.Write(buf)
+	rs.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write raft log failed: %w", err)
+	}
+	return rs.logFile.Sync()
+}
+
+// rewrite replaces the whole log, it is used when a follower drops conflicting entries.
+func (rs *raftStorage) rewrite(entries []RaftEntry) error {
+	err := writeFileSync(rs.logPath(), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("rewrite raft log failed: %w", err)
+	}
+	_ = rs.logFile.Close()
+	f, err := os.OpenFile(rs.logPath(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open raft log failed: %w", err)
+	}
+	rs.logFile = f
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat raft log failed: %w", err)
+	}
+	rs.size = info.Size()
+	return nil
+}
+
+func (rs *raftStorage) close() error {
+	return rs.logFile.Close()
+}
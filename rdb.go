@@ -0,0 +1,538 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The RDB file starts with rdbMagic and the format version, followed by one
+// record per key and rdbOpEOF. A record is the value type, the key, the
+// deadline in unix milliseconds (0 without one) and the value. Strings and
+// lengths are uvarint prefixed, scores are IEEE 754 bits in big endian. Since
+// version 2 the file ends with the CRC-64 of everything before it, since
+// version 3 rdbOpAux records holding a name and a value may precede the keys.
+const (
+	rdbMagic   = "KVRDB"
+	rdbVersion = 3
+)
+
+// rdbAuxAOFOffset is the AOF offset at the snapshot cut.
+const rdbAuxAOFOffset = "aof-offset"
+
+const (
+	rdbTypeString byte = iota
+	rdbTypeList
+	rdbTypeSet
+	rdbTypeHash
+	rdbTypeZSet
+
+	rdbOpAux byte = 0xfa
+	rdbOpEOF byte = 0xff
+)
+
+// rdbMaxLen bounds a string or collection length read from a file, so a
+// corrupted length fails instead of allocating without limit.
+const rdbMaxLen = respMaxBulkLen
+
+var (
+	errRDBFormat   = errors.New("invalid rdb file")
+	errRDBChecksum = errors.New("rdb checksum mismatch")
+)
+
+var rdbCRCTable = crc64.MakeTable(crc64.ECMA)
+
+type rdbEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *rdbEncoder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	_, _ = e.w.Write(e.buf[:n])
+}
+
+func (e *rdbEncoder) writeString(s string) {
+	e.writeUvarint(uint64(len(s)))
+	_, _ = e.w.WriteString(s)
+}
+
+func (e *rdbEncoder) writeFloat(f float64) {
+	binary.BigEndian.PutUint64(e.buf[:8], math.Float64bits(f))
+	_, _ = e.w.Write(e.buf[:8])
+}
+
+// writeEntry encodes one key, values of unknown types are an error.
+func (e *rdbEncoder) writeEntry(key string, value any, expireAt int64) error {
+	typ, ok := rdbValueType(value)
+	if !ok {
+		return fmt.Errorf("can not encode %s of type %T", key, value)
+	}
+	_ = e.w.WriteByte(typ)
+	e.writeHeader(key, expireAt)
+	e.writeValue(value)
+	return nil
+}
+
+func rdbValueType(value any) (byte, bool) {
+	switch value.(type) {
+	case string:
+		return rdbTypeString, true
+	case *List:
+		return rdbTypeList, true
+	case *Set:
+		return rdbTypeSet, true
+	case *Hash:
+		return rdbTypeHash, true
+	case *ZSet:
+		return rdbTypeZSet, true
+	}
+	return 0, false
+}
+
+func (e *rdbEncoder) writeValue(value any) {
+	switch v := value.(type) {
+	case string:
+		e.writeString(v)
+	case *List:
+		values := v.All()
+		e.writeUvarint(uint64(len(values)))
+		for _, s := range values {
+			e.writeString(s)
+		}
+	case *Set:
+		members := v.Members()
+		e.writeUvarint(uint64(len(members)))
+		for _, m := range members {
+			e.writeString(m)
+		}
+	case *Hash:
+		all := v.All()
+		e.writeUvarint(uint64(len(all)))
+		for f, val := range all {
+			e.writeString(f)
+			e.writeString(val)
+		}
+	case *ZSet:
+		members := v.Members()
+		e.writeUvarint(uint64(len(members)))
+		for _, m := range members {
+			e.writeString(m.Member)
+			e.writeFloat(m.Score)
+		}
+	}
+}
+
+// encodeValue encodes a value as its RDB type followed by its RDB encoding.
+func encodeValue(value any) ([]byte, error) {
+	typ, ok := rdbValueType(value)
+	if !ok {
+		return nil, fmt.Errorf("can not encode value of type %T", value)
+	}
+	var b bytes.Buffer
+	e := &rdbEncoder{w: bufio.NewWriter(&b)}
+	_ = e.w.WriteByte(typ)
+	e.writeValue(value)
+	if err := e.w.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeValue decodes a value encoded by encodeValue.
+func decodeValue(b []byte) (any, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty value", errRDBFormat)
+	}
+	d := &rdbDecoder{r: &checksumReader{r: bufio.NewReader(bytes.NewReader(b[1:])), h: crc64.New(rdbCRCTable)}}
+	return d.readValue(b[0])
+}
+
+func (e *rdbEncoder) writeHeader(key string, expireAt int64) {
+	e.writeString(key)
+	e.writeUvarint(uint64(expireAt))
+}
+
+// writeRDB encodes a point in time snapshot of the store and returns the AOF
+// offset of that instant, which is recorded in the snapshot as well.
+func (s *Server) writeRDB(w io.Writer) (int64, error) {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	offset := s.beginSnapshot(nil)
+	defer s.endSnapshot()
+	if err := s.encodeSnapshot(w, offset); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// encodeSnapshot writes the running snapshot in the RDB format.
+func (s *Server) encodeSnapshot(w io.Writer, offset int64) error {
+	h := crc64.New(rdbCRCTable)
+	e := &rdbEncoder{w: bufio.NewWriter(io.MultiWriter(w, h))}
+	_, _ = e.w.WriteString(rdbMagic)
+	_ = e.w.WriteByte(rdbVersion)
+	_ = e.w.WriteByte(rdbOpAux)
+	e.writeString(rdbAuxAOFOffset)
+	e.writeString(strconv.FormatInt(offset, 10))
+	if err := s.eachSnapshotKey(e.writeEntry); err != nil {
+		return err
+	}
+	_ = e.w.WriteByte(rdbOpEOF)
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, h.Sum64()))
+	return err
+}
+
+// checksumReader hashes the bytes read through it.
+type checksumReader struct {
+	r *bufio.Reader
+	h hash.Hash64
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	_, _ = c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		_, _ = c.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+type rdbDecoder struct {
+	r   *checksumReader
+	buf [8]byte
+}
+
+func (d *rdbDecoder) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(d.r)
+}
+
+func (d *rdbDecoder) readLen() (int, error) {
+	n, err := d.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > rdbMaxLen {
+		return 0, fmt.Errorf("%w: length %d is too large", errRDBFormat, n)
+	}
+	return int(n), nil
+}
+
+func (d *rdbDecoder) readString() (string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *rdbDecoder) readFloat() (float64, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(d.buf[:])), nil
+}
+
+// readStrings reads a length prefixed sequence of strings.
+func (d *rdbDecoder) readStrings() ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func (d *rdbDecoder) readValue(typ byte) (any, error) {
+	switch typ {
+	case rdbTypeString:
+		return d.readString()
+	case rdbTypeList:
+		values, err := d.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		return NewList(values...), nil
+	case rdbTypeSet:
+		members, err := d.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		set := &Set{Map: make(map[string]bool, len(members))}
+		set.Add(members...)
+		return set, nil
+	case rdbTypeHash:
+		fieldValues, err := d.readPairs()
+		if err != nil {
+			return nil, err
+		}
+		h := &Hash{Map: make(map[string]string, len(fieldValues)/2)}
+		h.Set(fieldValues...)
+		return h, nil
+	case rdbTypeZSet:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		z := NewZSet()
+		for i := 0; i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			score, err := d.readFloat()
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(score) {
+				return nil, fmt.Errorf("%w: score of %s is NaN", errRDBFormat, member)
+			}
+			z.Add(ZMember{Member: member, Score: score})
+		}
+		return z, nil
+	}
+	return nil, fmt.Errorf("%w: unknown value type %d", errRDBFormat, typ)
+}
+
+// readPairs reads a length prefixed sequence of string pairs.
+func (d *rdbDecoder) readPairs() ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, min(n, 1024)*2)
+	for i := 0; i < n*2; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// rdbEntry is a decoded key, ExpireAt is 0 for a key without deadline.
+type rdbEntry struct {
+	Key      string
+	Value    any
+	ExpireAt int64
+}
+
+// decodeRDB reads every entry and aux field of an RDB file and verifies its
+// checksum. A *bufio.Reader is read no further than the end of the RDB.
+func decodeRDB(r io.Reader) ([]rdbEntry, map[string]string, error) {
+	d := &rdbDecoder{r: &checksumReader{r: bufio.NewReader(r), h: crc64.New(rdbCRCTable)}}
+	header := make([]byte, len(rdbMagic)+1)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, nil, fmt.Errorf("%w: bad magic", errRDBFormat)
+	}
+	version := header[len(rdbMagic)]
+	if version > rdbVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", errRDBFormat, version)
+	}
+	var entries []rdbEntry
+	aux := map[string]string{}
+	for {
+		typ, err := d.r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+		}
+		if typ == rdbOpEOF {
+			break
+		}
+		if typ == rdbOpAux {
+			name, err := d.readString()
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+			}
+			value, err := d.readString()
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+			}
+			aux[name] = value
+			continue
+		}
+		key, err := d.readString()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+		}
+		at, err := d.readUvarint()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+		}
+		value, err := d.readValue(typ)
+		if err != nil {
+			if errors.Is(err, errRDBFormat) {
+				return nil, nil, err
+			}
+			return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+		}
+		entries = append(entries, rdbEntry{Key: key, Value: value, ExpireAt: int64(at)})
+	}
+	if version >= 2 {
+		sum := d.r.h.Sum64()
+		if _, err := io.ReadFull(d.r.r, d.buf[:]); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errRDBFormat, err)
+		}
+		if binary.LittleEndian.Uint64(d.buf[:]) != sum {
+			return nil, nil, errRDBChecksum
+		}
+	}
+	return entries, aux, nil
+}
+
+// readRDB loads the keys of an RDB file into the store, keys whose deadline
+// has passed are skipped. Nothing is loaded when the file is invalid.
+func (s *Server) readRDB(r io.Reader) error {
+	entries, _, err := decodeRDB(r)
+	if err != nil {
+		return err
+	}
+	return s.loadRDBEntries(entries)
+}
+
+// loadRDBEntries stores the entries, the expired ones are skipped unless keys
+// only expire through the log, as the commands replayed after an AOF preamble
+// expect the keys the snapshot had.
+func (s *Server) loadRDBEntries(entries []rdbEntry) error {
+	now := nowMs()
+	for _, e := range entries {
+		if e.ExpireAt > 0 {
+			if e.ExpireAt <= now && !s.expireByLog.Load() {
+				continue
+			}
+			s.expires.Store(e.Key, e.ExpireAt)
+		}
+		if err := s.storage.Put(e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshots are kept as rdbFilePrefix<seq>rdbFileSuffix, a higher sequence
+// is a newer snapshot.
+const (
+	rdbFilePrefix = "backup-"
+	rdbFileSuffix = ".rdb"
+)
+
+type rdbSnapshotFile struct {
+	seq  uint64
+	path string
+}
+
+func rdbSnapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", rdbFilePrefix, seq, rdbFileSuffix))
+}
+
+// listRDBSnapshots returns the snapshots in dir, newest first.
+func listRDBSnapshots(dir string) ([]rdbSnapshotFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []rdbSnapshotFile
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), rdbFilePrefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if name, ok = strings.CutSuffix(name, rdbFileSuffix); !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, rdbSnapshotFile{seq: seq, path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].seq > snapshots[j].seq })
+	return snapshots, nil
+}
+
+func (s *Server) readRDBFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return s.readRDB(f)
+}
+
+// readLegacyRDB loads the JSON backup written before the typed format, a
+// plain key value map. Lists and sets were marshalled as their struct fields,
+// so they are rebuilt from the "Values" and "Map" objects.
+func (s *Server) readLegacyRDB(b []byte) error {
+	store := map[string]any{}
+	if err := json.Unmarshal(b, &store); err != nil {
+		return fmt.Errorf("unmarshal legacy backup failed: %s", err)
+	}
+	for k, v := range store {
+		if err := s.storage.Put(k, legacyValue(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func legacyValue(v any) any {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	if raw, ok := obj["Values"]; ok {
+		values, _ := raw.([]any)
+		l := NewList()
+		for _, e := range values {
+			l.RPush(fmt.Sprint(e))
+		}
+		return l
+	}
+	if raw, ok := obj["Map"]; ok {
+		members, _ := raw.(map[string]any)
+		set := &Set{Map: make(map[string]bool, len(members))}
+		for m := range members {
+			set.Map[m] = true
+		}
+		return set
+	}
+	return v
+}
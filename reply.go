@@ -0,0 +1,109 @@
+package kvstore
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Commands return typed replies so that every protocol can encode them
+// faithfully: a string is a bulk string, nil is a null, int64 an integer, bool
+// a boolean, []string and []any are arrays, plus the reply types declared below.
+
+// statusReply is a simple status such as OK.
+type statusReply string
+
+// countReply is the integer reply of a write that the line protocol answered
+// with OK before it returned counts, the line protocol keeps answering OK.
+type countReply int64
+
+// setReply is an unordered collection of unique members.
+type setReply []string
+
+// mapReply is an ordered list of key value pairs.
+type mapReply []mapEntry
+
+type mapEntry struct {
+	Key   string
+	Value any
+}
+
+// scanReply is a page of a cursor based iteration. RESP nests the members
+// after the next cursor, the line protocol sends them in the same array.
+type scanReply struct {
+	Cursor  uint64
+	Members []string
+}
+
+const statusOK statusReply = "OK"
+
+// formatLine encodes a reply for the line protocol. Strings are framed as
+// "$<len>" and the raw bytes, nil as "$-1", other scalars are a single line,
+// arrays are framed as "*<n>" followed by n such strings. Every line ends with
+// LineSuffix.
+func formatLine(resp any) string {
+	switch v := resp.(type) {
+	case []string:
+		return formatLineArray(len(v), func(i int) any { return v[i] })
+	case setReply:
+		return formatLineArray(len(v), func(i int) any { return v[i] })
+	case []any:
+		return formatLineArray(len(v), func(i int) any { return v[i] })
+	case scanReply:
+		return formatLineArray(len(v.Members)+1, func(i int) any {
+			if i == 0 {
+				return strconv.FormatUint(v.Cursor, 10)
+			}
+			return v.Members[i-1]
+		})
+	case mapReply:
+		return formatLineArray(len(v)*2, func(i int) any {
+			if i%2 == 0 {
+				return v[i/2].Key
+			}
+			return v[i/2].Value
+		})
+	case nil, string:
+		var sb strings.Builder
+		writeLineBulk(&sb, resp)
+		return sb.String()
+	default:
+		return formatScalar(resp) + LineSuffix
+	}
+}
+
+func formatLineArray(n int, elem func(i int) any) string {
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(n) + LineSuffix)
+	for i := 0; i < n; i++ {
+		writeLineBulk(&sb, elem(i))
+	}
+	return sb.String()
+}
+
+// writeLineBulk writes e framed by its length, so it may contain LineSuffix.
+func writeLineBulk(sb *strings.Builder, e any) {
+	if e == nil {
+		sb.WriteString("$-1" + LineSuffix)
+		return
+	}
+	s := formatScalar(e)
+	sb.WriteString("$" + strconv.Itoa(len(s)) + LineSuffix)
+	sb.WriteString(s + LineSuffix)
+}
+
+func formatScalar(resp any) string {
+	switch v := resp.(type) {
+	case string:
+		return v
+	case statusReply:
+		return string(v)
+	case countReply:
+		return string(statusOK)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
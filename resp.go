@@ -0,0 +1,248 @@
+package kvstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// RESP type markers, see https://github.com/redis/redis-specifications/blob/master/protocol/RESP3.md
+const (
+	respArray  = '*'
+	respBulk   = '$'
+	respStatus = '+'
+	respError  = '-'
+	respInt    = ':'
+	respNull   = '_'
+	respMap    = '%'
+	respSet    = '~'
+)
+
+const (
+	respMaxArgs    = 1024 * 1024
+	respMaxBulkLen = 512 * 1024 * 1024
+)
+
+var errRESPProtocol = errors.New("protocol error")
+
+var respClientID atomic.Int64
+
+// readRESPCommand reads one command sent as an array of bulk strings, inline
+// commands are split on spaces like redis does.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != respArray {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != respBulk {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if string(b[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// respWriter encodes replies for a connection, proto is the negotiated RESP version.
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *respWriter) writeError(err error) {
+	msg := strings.ReplaceAll(err.Error(), "\r\n", " ")
+	// redis errors start with an upper case code, plain errors get the generic one
+	if code, _, _ := strings.Cut(msg, " "); code == "" || strings.ToUpper(code) != code {
+		msg = "ERR " + msg
+	}
+	w.writeLine(respError, msg)
+}
+
+func (w *respWriter) write(resp any) {
+	switch v := resp.(type) {
+	case nil:
+		if w.proto >= 3 {
+			w.writeLine(respNull, "")
+		} else {
+			w.writeLine(respBulk, "-1")
+		}
+	case string:
+		w.writeBulk(v)
+	case statusReply:
+		w.writeLine(respStatus, string(v))
+	case int64:
+		w.writeLine(respInt, strconv.FormatInt(v, 10))
+	case countReply:
+		w.writeLine(respInt, strconv.FormatInt(int64(v), 10))
+	case bool:
+		// redis answers predicates such as EXISTS with integers on both versions
+		if v {
+			w.writeLine(respInt, "1")
+		} else {
+			w.writeLine(respInt, "0")
+		}
+	case []string:
+		w.writeLine(respArray, strconv.Itoa(len(v)))
+		for _, s := range v {
+			w.writeBulk(s)
+		}
+	case []any:
+		w.writeLine(respArray, strconv.Itoa(len(v)))
+		for _, e := range v {
+			w.write(e)
+		}
+	case setReply:
+		if w.proto >= 3 {
+			w.writeLine(respSet, strconv.Itoa(len(v)))
+		} else {
+			w.writeLine(respArray, strconv.Itoa(len(v)))
+		}
+		for _, s := range v {
+			w.writeBulk(s)
+		}
+	case scanReply:
+		w.writeLine(respArray, "2")
+		w.writeBulk(strconv.FormatUint(v.Cursor, 10))
+		w.write(v.Members)
+	case mapReply:
+		if w.proto >= 3 {
+			w.writeLine(respMap, strconv.Itoa(len(v)))
+		} else {
+			w.writeLine(respArray, strconv.Itoa(len(v)*2))
+		}
+		for _, e := range v {
+			w.writeBulk(e.Key)
+			w.write(e.Value)
+		}
+	default:
+		w.writeError(fmt.Errorf("unsupported reply type %T", resp))
+	}
+}
+
+func (w *respWriter) writeLine(marker byte, s string) {
+	_ = w.w.WriteByte(marker)
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) writeBulk(s string) {
+	w.writeLine(respBulk, strconv.Itoa(len(s)))
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+// handleRESP serves a connection speaking RESP2, HELLO switches it to RESP3.
+func (s *Server) handleRESP(conn net.Conn, reader *bufio.Reader) {
+	w := &respWriter{w: bufio.NewWriter(conn), proto: 2}
+	id := respClientID.Add(1)
+
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				w.writeError(err)
+				_ = w.w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("Error reading message: %s", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		cmd := NewCmdArgs(args)
+
+		var resp any
+		if cmd.Name == "hello" {
+			resp, err = w.hello(cmd, id)
+		} else {
+			resp, err = s.executeConn(conn, reader, cmd)
+		}
+		if err != nil {
+			w.writeError(err)
+		} else {
+			w.write(resp)
+		}
+		// pipelined commands are answered with a single write
+		if reader.Buffered() == 0 {
+			if err := w.w.Flush(); err != nil {
+				log.Printf("Error writing message: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// hello negotiates the protocol version: HELLO [protover [AUTH user pass] [SETNAME name]].
+func (w *respWriter) hello(cmd *Cmd, id int64) (any, error) {
+	if len(cmd.Args) > 0 {
+		proto, err := strconv.Atoi(cmd.Args[0])
+		if err != nil {
+			return nil, errors.New("Protocol version is not an integer or out of range")
+		}
+		if proto != 2 && proto != 3 {
+			return nil, errors.New("NOPROTO unsupported protocol version")
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			switch strings.ToLower(cmd.Args[i]) {
+			case "auth":
+				i += 2
+			case "setname":
+				i++
+			default:
+				return nil, fmt.Errorf("syntax error in HELLO option '%s'", cmd.Args[i])
+			}
+			if i >= len(cmd.Args) {
+				return nil, errors.New("syntax error in HELLO")
+			}
+		}
+		w.proto = proto
+	}
+	return mapReply{
+		{Key: "server", Value: "kvstore"},
+		{Key: "version", Value: "1.0.0"},
+		{Key: "proto", Value: int64(w.proto)},
+		{Key: "id", Value: id},
+		{Key: "mode", Value: "standalone"},
+		{Key: "role", Value: "master"},
+		{Key: "modules", Value: []string{}},
+	}, nil
+}
@@ -3,29 +3,69 @@ package kvstore
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const LineSuffix = "\t\n"
+const (
+	LineSuffix  = "\t\n"
+	ErrorPrefix = "Error: "
+)
 
 type Server struct {
-	addr           string
-	store          sync.Map
+	addr    string
+	storage Storage
+	// keyLocks serializes the commands on a key
+	keyLocks keyLocks
+	// expires maps keys to their deadline in unix milliseconds
+	expires sync.Map
+	// expireByLog is set while keys only expire through logged commands: the
+	// AOF is being loaded or Raft replicates the keyspace. Replaying a log
+	// then gives the same keyspace whenever it runs.
+	expireByLog    atomic.Bool
+	backupPath     string
 	backupFile     string
 	aofFile        *os.File
+	aof            *aofWriter
+	aofSync        AOFSyncPolicy
+	aofRewriting   atomic.Bool
+	aofPreamble    bool
 	backupInterval time.Duration
-	BackupType     BackupType
+	// backupRetain is the number of RDB snapshots kept
+	backupRetain int
+	rdbMu        sync.Mutex
+	BackupType   BackupType
+	raft         *raftNode
+
+	// cmdMu is held for reading by every command and for writing by a
+	// snapshot taking its cut, snapshot is the running one
+	cmdMu      sync.RWMutex
+	snapshotMu sync.Mutex
+	snapshot   atomic.Pointer[cowSnapshot]
+
+	// conns are the open connections, they are drained on shutdown
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	connWG  sync.WaitGroup
+	// bgWG tracks the background jobs, shutdownCh receives SHUTDOWN requests
+	bgWG       sync.WaitGroup
+	shutdownCh chan shutdownMode
+	// blocked are the commands waiting for list elements, closing is closed
+	// on shutdown to wake them up
+	blocked blockingKeys
+	closing chan struct{}
 }
 
 type ServerOptions struct {
@@ -34,27 +74,96 @@ type ServerOptions struct {
 	BackupPath     string
 	BackupInterval time.Duration
 	BackupType     BackupType
+	// BackupRetain is the number of RDB snapshots kept, defaults to 3
+	BackupRetain int
+	// AOFSync is when the AOF is fsynced, defaults to AOFSyncEverySec
+	AOFSync AOFSyncPolicy
+	// AOFStrict refuses to start when the last AOF record is torn, instead of
+	// truncating it
+	AOFStrict bool
+	// AOFRewritePercentage rewrites the AOF once it grew by this percentage
+	// since the last rewrite, defaults to 100, a negative value disables it
+	AOFRewritePercentage int
+	// AOFUseRDBPreamble makes a rewritten AOF start with an RDB snapshot of
+	// the keyspace instead of commands, so it loads faster
+	AOFUseRDBPreamble bool
+	// AOFRewriteMinSize is the size below which the AOF is not rewritten
+	// automatically, defaults to 64MB
+	AOFRewriteMinSize int64
+	// Raft replicates mutating commands across a group of servers
+	Raft *RaftOptions
+	// Storage keeps the keyspace, defaults to a MemoryStorage. The server
+	// closes it when it stops.
+	Storage Storage
+	// ShutdownTimeout is how long the connections may keep running their
+	// commands once the server stops, defaults to 5s
+	ShutdownTimeout time.Duration
 }
 
 type BackupType string
 
+// legacyRDBFile is the JSON backup of older versions, it is only read.
+const legacyRDBFile = "backup-rdb.json"
+
+// defaultBackupRetain is the number of RDB snapshots kept by default.
+const defaultBackupRetain = 3
+
 var (
 	BackupAOF BackupType = "aof"
 	BackupRDB BackupType = "rdb"
 )
 
 func New(addr string) *Server {
-	return &Server{addr: addr, store: sync.Map{}}
+	return &Server{
+		addr:       addr,
+		storage:    NewMemoryStorage(),
+		conns:      map[net.Conn]struct{}{},
+		shutdownCh: make(chan shutdownMode, 1),
+		closing:    make(chan struct{}),
+	}
 }
 
+// Run serves until ctx is done or a SHUTDOWN command, then shuts down
+// gracefully and returns nil.
 func (s *Server) Run(ctx context.Context, options *ServerOptions) error {
+	if options != nil && options.Raft != nil && options.Backup {
+		return errors.New("backup can not be used with raft, the raft log is already durable")
+	}
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("new listen failed: %w", err)
 	}
+	defer func() { _ = listener.Close() }()
+
+	if options != nil && options.Storage != nil {
+		s.storage = options.Storage
+	}
+	// cancelling ctx stops the background jobs, whatever Run returns they are
+	// stopped before the AOF, the Raft node and the storage are closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		s.stopBackground(cancel)
+		if s.raft != nil {
+			s.raft.stop()
+		}
+		if s.aof != nil {
+			if err := s.aof.close(); err != nil {
+				log.Printf("close aof file failed: %s", err)
+			}
+		}
+		_ = s.storage.Close()
+	}()
+	// the backup or the Raft log is replayed into an empty keyspace
+	if options != nil && options.Storage != nil && (options.Backup || options.Raft != nil) {
+		if err := s.clearStorage(); err != nil {
+			return fmt.Errorf("clear storage failed: %w", err)
+		}
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
 	if options != nil {
-		if options.StartedCh != nil {
-			options.StartedCh <- struct{}{}
+		if options.ShutdownTimeout > 0 {
+			shutdownTimeout = options.ShutdownTimeout
 		}
 		if options.Backup {
 			if options.BackupPath == "" {
@@ -63,48 +172,134 @@ func (s *Server) Run(ctx context.Context, options *ServerOptions) error {
 			if options.BackupType == "" {
 				options.BackupType = BackupRDB
 			}
-			if options.BackupType == BackupRDB {
-				s.backupFile = fmt.Sprintf("%s/backup-rdb.json", options.BackupPath)
-			} else {
+			s.backupPath = options.BackupPath
+			if options.BackupType == BackupAOF {
 				s.backupFile = fmt.Sprintf("%s/backup-aof.txt", options.BackupPath)
 			}
+			if options.BackupRetain < 1 {
+				options.BackupRetain = defaultBackupRetain
+			}
+			s.backupRetain = options.BackupRetain
 			if options.BackupInterval < 1*time.Second {
 				options.BackupInterval = 1 * time.Second
 			}
 			s.backupInterval = options.BackupInterval
 			s.BackupType = options.BackupType
 			if s.BackupType == BackupRDB {
-				s.AsyncBackupRun()
+				s.AsyncBackupRun(ctx)
 			} else {
+				switch options.AOFSync {
+				case "":
+					options.AOFSync = AOFSyncEverySec
+				case AOFSyncAlways, AOFSyncEverySec, AOFSyncNo:
+				default:
+					return fmt.Errorf("invalid aof sync policy: %s", options.AOFSync)
+				}
+				s.aofSync = options.AOFSync
+				s.aofPreamble = options.AOFUseRDBPreamble
 				if err := s.openAOFFile(); err != nil {
 					return fmt.Errorf("open aof file failed: %w", err)
 				}
-				if err := s.recoverAOF(); err != nil {
+				if err := s.recoverAOF(options.AOFStrict); err != nil {
+					_ = s.aofFile.Close()
 					return fmt.Errorf("recover aof file failed: %w", err)
 				}
+				if s.aofSync == AOFSyncEverySec {
+					s.goBackground(func() { s.aof.syncLoop(ctx) })
+				}
+				if options.AOFRewritePercentage == 0 {
+					options.AOFRewritePercentage = defaultAOFRewritePercentage
+				}
+				if options.AOFRewriteMinSize <= 0 {
+					options.AOFRewriteMinSize = defaultAOFRewriteMinSize
+				}
+				s.goBackground(func() {
+					s.aofRewriteCron(ctx, options.AOFRewritePercentage, options.AOFRewriteMinSize)
+				})
+			}
+		}
+		if options.Raft != nil {
+			s.expireByLog.Store(true)
+			node, err := newRaftNode(s.addr, options.Raft, func(c string) (any, error) {
+				cmd, err := NewCmd(c)
+				if err != nil {
+					return nil, err
+				}
+				return s.handleCommand(cmd, false)
+			})
+			if err != nil {
+				return fmt.Errorf("new raft node failed: %w", err)
 			}
+			if err := node.start(); err != nil {
+				return fmt.Errorf("start raft node failed: %w", err)
+			}
+			s.raft = node
+		}
+		if options.StartedCh != nil {
+			options.StartedCh <- struct{}{}
 		}
 	}
 
-	defer func() { _ = listener.Close() }()
-
 	log.Printf("Server started at %s", s.addr)
 
-	go func() {
-		<-ctx.Done()
-		_ = listener.Close()
-	}()
+	s.goBackground(func() { s.activeExpire(ctx) })
+
+	acceptErr := make(chan error, 1)
+	go func() { acceptErr <- s.acceptConns(listener) }()
+
+	mode := shutdownDefault
+	select {
+	case <-ctx.Done():
+	case mode = <-s.shutdownCh:
+	case err = <-acceptErr:
+		acceptErr <- err
+	}
+	_ = listener.Close()
+	if err := <-acceptErr; err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("accept connection failed: %s", err)
+		s.shutdown(cancel, mode, shutdownTimeout)
+		return fmt.Errorf("accept connection failed: %w", err)
+	}
+	s.shutdown(cancel, mode, shutdownTimeout)
+	return nil
+}
 
+// acceptConns serves the connections of listener until it is closed.
+func (s *Server) acceptConns(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			return fmt.Errorf("accept connection failed: %w", err)
+			return err
 		}
-
-		go s.handleLine(conn)
+		s.connsMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+		s.connWG.Add(1)
+		go func() {
+			defer s.connWG.Done()
+			s.handleConn(conn)
+			s.connsMu.Lock()
+			delete(s.conns, conn)
+			s.connsMu.Unlock()
+		}()
 	}
 }
 
+// goBackground runs a background job, the shutdown waits for it.
+func (s *Server) goBackground(fn func()) {
+	s.bgWG.Add(1)
+	go func() {
+		defer s.bgWG.Done()
+		fn()
+	}()
+}
+
+// stopBackground cancels the context of the background jobs and waits for them.
+func (s *Server) stopBackground(cancel context.CancelFunc) {
+	cancel()
+	s.bgWG.Wait()
+}
+
 func (s *Server) openAOFFile() error {
 	f, err := os.OpenFile(s.backupFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
@@ -114,118 +309,173 @@ func (s *Server) openAOFFile() error {
 	return nil
 }
 
-func (s *Server) recoverAOF() error {
-	reader := bufio.NewReader(s.aofFile)
-
-	recoverCmdCount := 0
-	for {
-		cmd, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("read aof file line failed: %w", err)
+// recoverAOF replays the AOF. A torn last record, left by a crash during a
+// write, is truncated with a warning unless strict is set, any other invalid
+// record fails the recovery.
+func (s *Server) recoverAOF(strict bool) error {
+	s.expireByLog.Store(true)
+	defer s.expireByLog.Store(false)
+	load := func(entries []rdbEntry) error {
+		log.Printf("Loading %d keys from the rdb preamble", len(entries))
+		return s.loadRDBEntries(entries)
+	}
+	recoverCmdCount, valid, err := scanAOF(s.aofFile, load, func(cmd *Cmd) error {
+		if _, err := s.handleCommand(cmd, false); err != nil {
+			return fmt.Errorf("handle command %s failed: %w", cmd.FullName, err)
 		}
-		if cmd == "" || cmd == "\n" {
-			continue
+		return nil
+	})
+	if err != nil {
+		var corrupt *AOFCorruptError
+		if !errors.As(err, &corrupt) || !corrupt.Tail || strict {
+			return err
 		}
-
-		if _, err := s.handleCommand(cmd, false); err != nil {
-			return fmt.Errorf("handle command %s failed: %w", cmd, err)
+		log.Printf("WARNING: %s of %s, truncating the aof to %d bytes", err, s.backupFile, valid)
+		if err := s.aofFile.Truncate(valid); err != nil {
+			return fmt.Errorf("truncate aof file failed: %w", err)
 		}
-		recoverCmdCount++
 	}
 
 	log.Printf("Recovered %d commands", recoverCmdCount)
 
+	info, err := s.aofFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat aof file failed: %w", err)
+	}
+	s.aof = newAOFWriter(s.aofFile, s.backupFile, info.Size(), s.aofSync)
+
 	return nil
 }
 
 func (s *Server) appendAOF(cmd string) error {
-	_, err := s.aofFile.WriteString(fmt.Sprintf("%s\n", cmd))
-	if err != nil {
+	if err := s.aof.append(encodeAOFRecord(cmd)); err != nil {
 		return fmt.Errorf("append aof failed: %w", err)
 	}
 	return nil
 }
 
+// ReadBackup loads the newest valid RDB snapshot, older snapshots are tried
+// when the newest is truncated or corrupted. A JSON backup written by an older
+// version is loaded when there is no snapshot yet.
 func (s *Server) ReadBackup() error {
-	f, err := os.OpenFile(s.backupFile, os.O_RDONLY, 0644)
+	snapshots, err := listRDBSnapshots(s.backupPath)
 	if err != nil {
-		if os.IsNotExist(err) {
+		return fmt.Errorf("list snapshots failed: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return s.readLegacyBackup()
+	}
+	for _, snapshot := range snapshots {
+		err := s.readRDBFile(snapshot.path)
+		if err == nil {
+			log.Printf("Loaded snapshot %s", snapshot.path)
 			return nil
 		}
-		return fmt.Errorf("open backup.json failed: %s", err)
+		log.Printf("Skip invalid snapshot %s: %s", snapshot.path, err)
 	}
-	b, err := io.ReadAll(f)
+	return fmt.Errorf("no valid snapshot in %s", s.backupPath)
+}
+
+func (s *Server) readLegacyBackup() error {
+	path := filepath.Join(s.backupPath, legacyRDBFile)
+	b, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("read backup.json failed: %s", err)
-	}
-	if len(b) > 0 {
-		store := map[string]any{}
-		err = json.Unmarshal(b, &store)
-		if err != nil {
-			return fmt.Errorf("unmarshal backup.json failed: %s", err)
-		}
-		for k, v := range store {
-			s.store.Store(k, v)
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return fmt.Errorf("read %s failed: %s", path, err)
 	}
-	return nil
+	if len(b) == 0 {
+		return nil
+	}
+	return s.readLegacyRDB(b)
 }
 
+// WriteBackup atomically writes a new snapshot, then removes the snapshots
+// beyond the retention.
 func (s *Server) WriteBackup() error {
-	f, err := os.OpenFile(s.backupFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	s.rdbMu.Lock()
+	defer s.rdbMu.Unlock()
+	snapshots, err := listRDBSnapshots(s.backupPath)
 	if err != nil {
-		return fmt.Errorf("open backup.json failed: %s", err)
+		return fmt.Errorf("list snapshots failed: %w", err)
 	}
-	defer func() { _ = f.Close() }()
-	store := map[string]any{}
-	s.store.Range(func(k, v any) bool {
-		store[k.(string)] = v
-		return true
+	var seq uint64 = 1
+	if len(snapshots) > 0 {
+		seq = snapshots[0].seq + 1
+	}
+	path := rdbSnapshotPath(s.backupPath, seq)
+	var offset int64
+	err = writeFileSync(path, func(w io.Writer) (err error) {
+		offset, err = s.writeRDB(w)
+		return err
 	})
-	b, err := json.Marshal(store)
 	if err != nil {
-		return fmt.Errorf("marshal store failed: %s", err)
+		return fmt.Errorf("write %s failed: %w", path, err)
 	}
-	_, err = f.Write(b)
-	if err != nil {
-		return fmt.Errorf("write backup.json failed: %s", err)
+	log.Printf("Saved snapshot %s at aof offset %d", path, offset)
+	if len(snapshots) >= s.backupRetain {
+		for _, old := range snapshots[s.backupRetain-1:] {
+			if err := os.Remove(old.path); err != nil {
+				log.Printf("remove snapshot %s failed: %s", old.path, err)
+			}
+		}
 	}
 	return nil
 }
 
-func (s *Server) AsyncBackupRun() {
+// AsyncBackupRun loads the backup, then writes a snapshot every backup
+// interval until ctx is done.
+func (s *Server) AsyncBackupRun(ctx context.Context) {
 	// load from backup
 	if err := s.ReadBackup(); err != nil {
 		log.Printf("read backup failed: %s", err)
 	}
-	go func() {
+	s.goBackground(func() {
 		t := time.NewTicker(s.backupInterval)
+		defer t.Stop()
 		for {
-			<-t.C
-			//fmt.Println("backup...")
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
 			if err := s.WriteBackup(); err != nil {
 				log.Printf("async backup failed: %s", err)
 			}
-			//fmt.Println("backup done")
 		}
-	}()
+	})
 }
 
-func (s *Server) handleLine(conn net.Conn) {
+// handleConn detects the protocol from the first byte of the connection, a
+// RESP client always starts with an array while the line protocol is plain text.
+func (s *Server) handleConn(conn net.Conn) {
 	defer func() { _ = conn.Close() }()
 
 	log.Printf("Connection from %s", conn.RemoteAddr())
 
 	reader := bufio.NewReader(conn)
+	b, err := reader.Peek(1)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Error reading message: %s", err)
+		}
+		return
+	}
+	if b[0] == respArray {
+		s.handleRESP(conn, reader)
+	} else {
+		s.handleLine(conn, reader)
+	}
+}
 
+func (s *Server) handleLine(conn net.Conn, reader *bufio.Reader) {
 	for {
 		var cmd string
 		var err error
 		if cmd, err = reader.ReadString('\n'); err != nil {
-			if !errors.Is(err, io.EOF) {
+			// the read deadline is set when the server shuts down
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
 				log.Printf("Error reading message: %s", err)
 				return
 			}
@@ -233,14 +483,16 @@ func (s *Server) handleLine(conn net.Conn) {
 		}
 		cmd = strings.TrimSuffix(cmd, LineSuffix)
 		fmt.Printf("Message incoming: %s\n", cmd)
-		if resp, err := s.handleCommand(cmd, s.BackupType == BackupAOF); err != nil {
-			_, err2 := conn.Write([]byte(fmt.Sprintf("Error: %s%s", err, LineSuffix)))
+		if resp, err := s.executeLine(conn, reader, cmd); err != nil {
+			// an error is a single line, even when it quotes an argument holding LineSuffix
+			msg := strings.ReplaceAll(err.Error(), LineSuffix, " ")
+			_, err2 := conn.Write([]byte(fmt.Sprintf("%s%s%s", ErrorPrefix, msg, LineSuffix)))
 			if err2 != nil {
 				log.Printf("Error writing message: %s", err2)
 				return
 			}
 		} else {
-			_, err2 := conn.Write([]byte(fmt.Sprintf("%s%s", resp, LineSuffix)))
+			_, err2 := conn.Write([]byte(formatLine(resp)))
 			if err2 != nil {
 				log.Printf("Error writing message: %s", err2)
 				return
@@ -249,68 +501,175 @@ func (s *Server) handleLine(conn net.Conn) {
 	}
 }
 
-func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
+// IsLeader reports whether the server is the Raft leader, a server without Raft
+// always accepts writes.
+func (s *Server) IsLeader() bool {
+	if s.raft == nil {
+		return true
+	}
+	return s.raft.isLeader()
+}
+
+// RaftStats returns the state of the Raft node, ok is false without Raft.
+func (s *Server) RaftStats() (stats RaftStats, ok bool) {
+	if s.raft == nil {
+		return RaftStats{}, false
+	}
+	return s.raft.stats(), true
+}
+
+// execute runs a command received from a client. With Raft enabled mutating
+// commands are applied once committed, reads are served from the local state.
+func (s *Server) execute(cmd *Cmd) (any, error) {
+	cmd, err := absoluteExpire(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if cmd, err = seedSPop(cmd); err != nil {
+		return nil, err
+	}
+	if cmd.Name == "expired" {
+		// only logged by the Raft leader
+		return nil, fmt.Errorf("unknown command: %s", cmd.FullName)
+	}
+	if isBlocking(cmd) {
+		return s.executeBlocking(cmd, nil)
+	}
+	if s.raft != nil && s.raft.isLeader() {
+		if err := s.proposeExpired(commandKeys(cmd)); err != nil {
+			return nil, err
+		}
+	}
+	if s.raft != nil && isWrite(cmd) {
+		return s.raft.propose(cmd.canonical())
+	}
+	return s.handleCommand(cmd, s.BackupType == BackupAOF)
+}
+
+func (s *Server) executeLine(conn net.Conn, reader *bufio.Reader, c string) (any, error) {
+	cmd, err := NewCmd(c)
+	if err != nil {
+		return nil, err
+	}
+	return s.executeConn(conn, reader, cmd)
+}
+
+func (s *Server) handleCommand(cmd *Cmd, aof bool) (resp any, err error) {
+	// the AOF is appended before the lock is released, so a snapshot cut sees
+	// either both the change and its AOF record or neither
+	s.cmdMu.RLock()
+	defer s.cmdMu.RUnlock()
+	defer s.keyLocks.lock(commandKeys(cmd), isWrite(cmd))()
+	if err := s.preserveKeys(cmd); err != nil {
+		return "", err
+	}
+
 	defer func() {
-		if err == nil && aof {
-			if err := s.appendAOF(c); err != nil {
-				log.Printf("appand aof file failed: %s", err)
+		if err == nil {
+			s.blocked.signal(pushedKeys(cmd, resp))
+		}
+		if err == nil && aof && isWrite(cmd) {
+			if aofErr := s.appendAOF(cmd.canonical()); aofErr != nil {
+				log.Printf("appand aof file failed: %s", aofErr)
+				// with always a write is only acknowledged once it is durable
+				if s.aofSync == AOFSyncAlways {
+					resp, err = nil, aofErr
+				}
 			}
 		}
 	}()
-	cmd := NewCmd(c)
 
 	switch cmd.Name {
 	case "ping":
 		resp = s.handlePing()
+	case "bgrewriteaof":
+		if resp, err = s.handleBGRewriteAOF(); err != nil {
+			return "", err
+		}
+	case "shutdown":
+		if len(cmd.Args) > 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if resp, err = s.handleShutdown(cmd.Args); err != nil {
+			return "", err
+		}
 	case "get":
 		if len(cmd.Args) != 1 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		resp = s.handleGet(cmd.Args[0])
+		if resp, err = s.handleGet(cmd.Args[0]); err != nil {
+			return "", err
+		}
 	case "set":
 		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
+		// set key value EX|PX|EXAT|PXAT time, execute rewrites the relative forms to PXAT
+		if unit, absolute, ok := setExpireOption(cmd.Args); ok {
+			at, err := parseExpireAt(cmd.Args[3], unit, absolute)
+			if err != nil {
+				return "", err
+			}
+			if err := s.handleSet(map[string]string{cmd.Args[0]: cmd.Args[1]}); err != nil {
+				return "", err
+			}
+			if _, err := s.setExpire(cmd.Args[0], at); err != nil {
+				return "", err
+			}
+			resp = statusOK
+			break
+		}
 		m := map[string]string{}
 		for i := 0; i < len(cmd.Args); i += 2 {
 			m[cmd.Args[i]] = cmd.Args[i+1]
 		}
-		s.handleSet(m)
-		resp = "OK"
+		if err := s.handleSet(m); err != nil {
+			return "", err
+		}
+		resp = statusOK
 	case "exists":
 		if len(cmd.Args) != 1 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		resp = s.handleExists(cmd.Args[0])
+		if resp, err = s.handleExists(cmd.Args[0]); err != nil {
+			return "", err
+		}
 	case "keys":
-		keys := s.handleKeys()
-		resp = strings.Join(keys, ",")
+		if resp, err = s.handleKeys(); err != nil {
+			return "", err
+		}
 	case "del":
 		if len(cmd.Args) < 1 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		s.handleDel(cmd.Args...)
-		resp = "OK"
+		if n, err := s.handleDel(cmd.Args...); err != nil {
+			return "", err
+		} else {
+			resp = countReply(n)
+		}
 	case "lpush":
 		if len(cmd.Args) < 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		if err := s.handleLPush(cmd.Args[0], cmd.Args[1:]...); err != nil {
+		if n, err := s.handleLPush(cmd.Args[0], cmd.Args[1:]...); err != nil {
 			return "", err
+		} else {
+			resp = countReply(n)
 		}
-		resp = "OK"
 	case "rpush":
 		if len(cmd.Args) < 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		if err := s.handleRPush(cmd.Args[0], cmd.Args[1:]...); err != nil {
+		if n, err := s.handleRPush(cmd.Args[0], cmd.Args[1:]...); err != nil {
 			return "", err
+		} else {
+			resp = countReply(n)
 		}
-		resp = "OK"
-	case "lpop":
+	case "lpop", "rpop":
 		if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
+		// without a count the reply is a single element, like redis
 		var n = 1
 		if len(cmd.Args) == 2 {
 			n, err = strconv.Atoi(cmd.Args[1])
@@ -318,10 +677,121 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 				return "", fmt.Errorf("invalid n value: %s", cmd.FullName)
 			}
 		}
-		if values, err := s.handleLPop(cmd.Args[0], n); err != nil {
+		if values, err := s.handlePop(cmd.Args[0], n, cmd.Name == "lpop"); err != nil {
+			return "", err
+		} else if len(cmd.Args) == 2 {
+			resp = values
+		} else if len(values) > 0 {
+			resp = values[0]
+		}
+	case "lset":
+		if len(cmd.Args) != 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		index, err := strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid index value: %s", cmd.Args[1])
+		}
+		if err := s.handleLSet(cmd.Args[0], index, cmd.Args[2]); err != nil {
+			return "", err
+		}
+		resp = statusOK
+	case "linsert":
+		// linsert key BEFORE|AFTER pivot element
+		if len(cmd.Args) != 4 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		var after bool
+		switch strings.ToLower(cmd.Args[1]) {
+		case "before":
+		case "after":
+			after = true
+		default:
+			return "", fmt.Errorf("syntax error: %s", cmd.Args[1])
+		}
+		if n, err := s.handleLInsert(cmd.Args[0], cmd.Args[2], cmd.Args[3], after); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "lrem":
+		if len(cmd.Args) != 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		count, err := strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid count value: %s", cmd.Args[1])
+		}
+		if n, err := s.handleLRem(cmd.Args[0], count, cmd.Args[2]); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "lpos":
+		// lpos key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		rank, count, maxLen, withCount := 1, 0, 0, false
+		for i := 2; i < len(cmd.Args); i += 2 {
+			v, err := strconv.Atoi(cmd.Args[i+1])
+			if err != nil {
+				return "", fmt.Errorf("invalid %s value: %s", strings.ToLower(cmd.Args[i]), cmd.Args[i+1])
+			}
+			switch strings.ToLower(cmd.Args[i]) {
+			case "rank":
+				if v == 0 {
+					return "", errors.New("RANK can't be zero")
+				}
+				rank = v
+			case "count":
+				if v < 0 {
+					return "", errors.New("COUNT can't be negative")
+				}
+				count, withCount = v, true
+			case "maxlen":
+				if v < 0 {
+					return "", errors.New("MAXLEN can't be negative")
+				}
+				maxLen = v
+			default:
+				return "", fmt.Errorf("syntax error: %s", cmd.Args[i])
+			}
+		}
+		if !withCount {
+			count = 1
+		}
+		indexes, err := s.handleLPos(cmd.Args[0], cmd.Args[1], rank, count, maxLen)
+		if err != nil {
 			return "", err
+		}
+		if withCount {
+			reply := make([]any, 0, len(indexes))
+			for _, i := range indexes {
+				reply = append(reply, int64(i))
+			}
+			resp = reply
+		} else if len(indexes) > 0 {
+			resp = int64(indexes[0])
 		} else {
-			resp = strings.Join(values, ",")
+			resp = nil
+		}
+	case "lmove", "rpoplpush":
+		// lmove source destination LEFT|RIGHT LEFT|RIGHT, rpoplpush is lmove RIGHT LEFT
+		if (cmd.Name == "lmove" && len(cmd.Args) != 4) || (cmd.Name == "rpoplpush" && len(cmd.Args) != 2) {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		fromLeft, toLeft := false, true
+		if cmd.Name == "lmove" {
+			if fromLeft, err = parseListEnd(cmd.Args[2]); err != nil {
+				return "", err
+			}
+			if toLeft, err = parseListEnd(cmd.Args[3]); err != nil {
+				return "", err
+			}
+		}
+		if resp, err = s.handleLMove(cmd.Args[0], cmd.Args[1], fromLeft, toLeft); err != nil {
+			return "", err
 		}
 	case "llen":
 		if len(cmd.Args) != 1 {
@@ -330,7 +800,7 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 		if l, err := s.handleLLen(cmd.Args[0]); err != nil {
 			return "", err
 		} else {
-			resp = strconv.Itoa(int(l))
+			resp = l
 		}
 	case "lrange":
 		if len(cmd.Args) != 3 {
@@ -348,7 +818,7 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 		if l, err := s.handleLRange(key, start, stop); err != nil {
 			return "", err
 		} else {
-			resp = strings.Join(l, ",")
+			resp = l
 		}
 	case "ltrim":
 		if len(cmd.Args) != 3 {
@@ -366,7 +836,7 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 		if err := s.handleLTrim(key, start, stop); err != nil {
 			return "", err
 		} else {
-			resp = "OK"
+			resp = statusOK
 		}
 	case "lindex":
 		if len(cmd.Args) != 2 {
@@ -386,21 +856,56 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 		if len(cmd.Args) < 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		if err := s.handleSAdd(cmd.Args[0], cmd.Args[1:]...); err != nil {
+		if n, err := s.handleSAdd(cmd.Args[0], cmd.Args[1:]...); err != nil {
 			return "", err
+		} else {
+			resp = countReply(n)
 		}
-		resp = "OK"
 	case "smembers":
-		if len(cmd.Args) != 1 {
+		// smembers key [SORTED]
+		if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
 		key := cmd.Args[0]
 
+		if len(cmd.Args) == 2 && !strings.EqualFold(cmd.Args[1], "sorted") {
+			return "", fmt.Errorf("syntax error: %s", cmd.Args[1])
+		}
 		if l, err := s.handleLSMembers(key); err != nil {
 			return "", err
 		} else {
-			resp = strings.Join(l, ",")
+			if len(cmd.Args) == 2 {
+				sort.Strings(l)
+			}
+			resp = setReply(l)
+		}
+	case "sscan":
+		// sscan key cursor [MATCH pattern] [COUNT count]
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		cursor, err := strconv.ParseUint(cmd.Args[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid cursor value: %s", cmd.Args[1])
+		}
+		match, count := "", defaultScanCount
+		for i := 2; i < len(cmd.Args); i += 2 {
+			switch strings.ToLower(cmd.Args[i]) {
+			case "match":
+				match = cmd.Args[i+1]
+			case "count":
+				if count, err = strconv.Atoi(cmd.Args[i+1]); err != nil || count < 1 {
+					return "", fmt.Errorf("invalid count value: %s", cmd.Args[i+1])
+				}
+			default:
+				return "", fmt.Errorf("syntax error: %s", cmd.Args[i])
+			}
+		}
+		members, next, err := s.handleSScan(cmd.Args[0], cursor, match, count)
+		if err != nil {
+			return "", err
 		}
+		resp = scanReply{Cursor: next, Members: members}
 	case "sismember":
 		if len(cmd.Args) != 2 {
 			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
@@ -411,204 +916,912 @@ func (s *Server) handleCommand(c string, aof bool) (resp string, err error) {
 		if b, err := s.handleLSIsMember(key, val); err != nil {
 			return "", err
 		} else {
-			if b {
-				resp = "true"
-			} else {
-				resp = "false"
-			}
+			resp = b
 		}
-	default:
-		return "", fmt.Errorf("unknown command: %s", cmd.FullName)
-	}
-
-	return resp, nil
-}
-
-func (s *Server) handlePing() string {
-	return "pong"
-}
-
-func (s *Server) handleGet(key string) string {
-	if v, ok := s.store.Load(key); ok {
-		switch v.(type) {
-		case string:
-			return v.(string)
-		case *List:
-			return strings.Join(v.(*List).Values, ",")
-		default:
-			return ""
+	case "srem":
+		if len(cmd.Args) < 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-	}
-	return ""
-}
-
-func (s *Server) handleSet(m map[string]string) {
-	for k, v := range m {
-		s.store.Store(k, v)
-	}
-}
-
-func (s *Server) handleDel(keys ...string) {
-	for _, key := range keys {
-		s.store.Delete(key)
-	}
-}
-
-func (s *Server) handleLPush(key string, values ...string) error {
-	raw, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := raw.(*List); ok {
-		val.LPush(values...)
-		return nil
-	} else {
-		return fmt.Errorf("invalid list type: %T", raw)
-	}
-}
-
-func (s *Server) handleRPush(key string, values ...string) error {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		val.Values = append(val.Values, values...)
-		return nil
-	} else {
-		return fmt.Errorf("invalid list type: %T", val)
-	}
-}
-
-func (s *Server) handleLPop(key string, n int) ([]string, error) {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		if len(val.Values) <= n {
-			values := val.Values
-			val.Values = []string{}
-			return values, nil
+		if n, err := s.handleSRem(cmd.Args[0], cmd.Args[1:]...); err != nil {
+			return "", err
 		} else {
-			values := val.Values[:n]
-			val.Values = val.Values[n:]
-			return values, nil
+			resp = int64(n)
 		}
-	} else {
-		return nil, fmt.Errorf("invalid list type: %T", val)
-	}
-}
-
-func (s *Server) handleLRange(key string, start int, stop int) ([]string, error) {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		if len(val.Values) == 0 {
-			return []string{}, nil
+	case "scard":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		if start >= len(val.Values) {
-			return []string{}, nil
+		if n, err := s.handleSCard(cmd.Args[0]); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
 		}
-		if stop > len(val.Values)-1 {
-			stop = len(val.Values) - 1
+	case "spop":
+		// spop key [count] [SEED seed], execute adds the seed
+		args, seed, err := parseSPopSeed(cmd.Args)
+		if err != nil {
+			return "", err
 		}
-		if stop < 0 {
-			stop = len(val.Values) + stop
+		if len(args) < 1 || len(args) > 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
 		}
-		return val.Values[start : stop+1], nil
-	} else {
-		return nil, fmt.Errorf("invalid list type: %T", val)
-	}
+		count := 1
+		if len(args) == 2 {
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+				return "", fmt.Errorf("invalid count value: %s", args[1])
+			}
+		}
+		members, err := s.handleSPop(args[0], count, seed)
+		if err != nil {
+			return "", err
+		}
+		if len(args) == 2 {
+			resp = members
+		} else if len(members) > 0 {
+			resp = members[0]
+		} else {
+			resp = nil
+		}
+	case "srandmember":
+		// srandmember key [count]
+		if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		count := 1
+		if len(cmd.Args) == 2 {
+			// like redis, a negative count must be negatable with room to spare
+			if count, err = strconv.Atoi(cmd.Args[1]); err != nil || count <= math.MinInt/2 {
+				return "", fmt.Errorf("invalid count value: %s", cmd.Args[1])
+			}
+		}
+		members, err := s.handleSRandMember(cmd.Args[0], count)
+		if err != nil {
+			return "", err
+		}
+		if len(cmd.Args) == 2 {
+			resp = members
+		} else if len(members) > 0 {
+			resp = members[0]
+		} else {
+			resp = nil
+		}
+	case "smove":
+		if len(cmd.Args) != 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if resp, err = s.handleSMove(cmd.Args[0], cmd.Args[1], cmd.Args[2]); err != nil {
+			return "", err
+		}
+	case "sinter", "sunion", "sdiff":
+		if len(cmd.Args) < 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if members, err := s.handleSetAlgebra(cmd.Name[1:], cmd.Args...); err != nil {
+			return "", err
+		} else {
+			resp = setReply(members)
+		}
+	case "sinterstore", "sunionstore", "sdiffstore":
+		// sinterstore destination key [key ...]
+		if len(cmd.Args) < 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		op := strings.TrimSuffix(cmd.Name[1:], "store")
+		if n, err := s.handleSetAlgebraStore(op, cmd.Args[0], cmd.Args[1:]...); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "expire", "pexpire", "pexpireat":
+		if len(cmd.Args) != 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		unit, absolute := time.Second, false
+		if cmd.Name != "expire" {
+			unit = time.Millisecond
+			absolute = cmd.Name == "pexpireat"
+		}
+		at, err := parseExpireAt(cmd.Args[1], unit, absolute)
+		if err != nil {
+			return "", err
+		}
+		if resp, err = s.setExpire(cmd.Args[0], at); err != nil {
+			return "", err
+		}
+	case "ttl", "pttl":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		unit := time.Second
+		if cmd.Name == "pttl" {
+			unit = time.Millisecond
+		}
+		if resp, err = s.handleTTL(cmd.Args[0], unit); err != nil {
+			return "", err
+		}
+	case "expired":
+		// expired key deadline, proposed by the Raft leader
+		if len(cmd.Args) != 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		at, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid expire time: %s", cmd.Args[1])
+		}
+		if resp, err = s.handleExpired(cmd.Args[0], at); err != nil {
+			return "", err
+		}
+	case "persist":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if resp, err = s.handlePersist(cmd.Args[0]); err != nil {
+			return "", err
+		}
+	case "hset":
+		if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if n, err := s.handleHSet(cmd.Args[0], cmd.Args[1:]...); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "hget":
+		if len(cmd.Args) != 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if val, err := s.handleHGet(cmd.Args[0], cmd.Args[1]); err != nil {
+			return "", err
+		} else {
+			resp = val
+		}
+	case "hdel":
+		if len(cmd.Args) < 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if n, err := s.handleHDel(cmd.Args[0], cmd.Args[1:]...); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "hgetall":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if m, err := s.handleHGetAll(cmd.Args[0]); err != nil {
+			return "", err
+		} else {
+			resp = m
+		}
+	case "hincrby":
+		if len(cmd.Args) != 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		n, err := strconv.ParseInt(cmd.Args[2], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid increment value: %s", cmd.Args[2])
+		}
+		if val, err := s.handleHIncrBy(cmd.Args[0], cmd.Args[1], n); err != nil {
+			return "", err
+		} else {
+			resp = val
+		}
+	case "hkeys":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if fields, err := s.handleHKeys(cmd.Args[0]); err != nil {
+			return "", err
+		} else {
+			resp = fields
+		}
+	case "hlen":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if l, err := s.handleHLen(cmd.Args[0]); err != nil {
+			return "", err
+		} else {
+			resp = l
+		}
+	case "zadd":
+		if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		members := make([]ZMember, 0, len(cmd.Args)/2)
+		for i := 1; i < len(cmd.Args); i += 2 {
+			score, err := parseScore(cmd.Args[i])
+			if err != nil {
+				return "", err
+			}
+			members = append(members, ZMember{Member: cmd.Args[i+1], Score: score})
+		}
+		if n, err := s.handleZAdd(cmd.Args[0], members...); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "zrem":
+		if len(cmd.Args) < 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if n, err := s.handleZRem(cmd.Args[0], cmd.Args[1:]...); err != nil {
+			return "", err
+		} else {
+			resp = int64(n)
+		}
+	case "zscore":
+		if len(cmd.Args) != 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if score, err := s.handleZScore(cmd.Args[0], cmd.Args[1]); err != nil {
+			return "", err
+		} else {
+			resp = score
+		}
+	case "zrank", "zrevrank":
+		if len(cmd.Args) != 2 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if rank, err := s.handleZRank(cmd.Args[0], cmd.Args[1], cmd.Name == "zrevrank"); err != nil {
+			return "", err
+		} else {
+			resp = rank
+		}
+	case "zrange", "zrevrange":
+		// zrange key start stop [WITHSCORES]
+		if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		start, err := strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid start value: %s", cmd.Args[1])
+		}
+		stop, err := strconv.Atoi(cmd.Args[2])
+		if err != nil {
+			return "", fmt.Errorf("invalid stop value: %s", cmd.Args[2])
+		}
+		withScores := false
+		if len(cmd.Args) == 4 {
+			if strings.ToLower(cmd.Args[3]) != "withscores" {
+				return "", fmt.Errorf("syntax error: %s", cmd.Args[3])
+			}
+			withScores = true
+		}
+		if members, err := s.handleZRange(cmd.Args[0], start, stop, cmd.Name == "zrevrange"); err != nil {
+			return "", err
+		} else {
+			resp = zsetReply(members, withScores)
+		}
+	case "zrangebyscore":
+		// zrangebyscore key min max [WITHSCORES] [LIMIT offset count]
+		if len(cmd.Args) < 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		min, err := parseZSetBound(cmd.Args[1])
+		if err != nil {
+			return "", err
+		}
+		max, err := parseZSetBound(cmd.Args[2])
+		if err != nil {
+			return "", err
+		}
+		withScores, offset, count := false, 0, -1
+		for i := 3; i < len(cmd.Args); i++ {
+			switch strings.ToLower(cmd.Args[i]) {
+			case "withscores":
+				withScores = true
+			case "limit":
+				if i+2 >= len(cmd.Args) {
+					return "", fmt.Errorf("syntax error: %s", cmd.FullName)
+				}
+				if offset, err = strconv.Atoi(cmd.Args[i+1]); err != nil {
+					return "", fmt.Errorf("invalid offset value: %s", cmd.Args[i+1])
+				}
+				if count, err = strconv.Atoi(cmd.Args[i+2]); err != nil {
+					return "", fmt.Errorf("invalid count value: %s", cmd.Args[i+2])
+				}
+				i += 2
+			default:
+				return "", fmt.Errorf("syntax error: %s", cmd.Args[i])
+			}
+		}
+		if members, err := s.handleZRangeByScore(cmd.Args[0], min, max, offset, count); err != nil {
+			return "", err
+		} else {
+			resp = zsetReply(members, withScores)
+		}
+	case "zincrby":
+		if len(cmd.Args) != 3 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		delta, err := parseScore(cmd.Args[1])
+		if err != nil {
+			return "", err
+		}
+		if score, err := s.handleZIncrBy(cmd.Args[0], cmd.Args[2], delta); err != nil {
+			return "", err
+		} else {
+			resp = formatScore(score)
+		}
+	case "zcard":
+		if len(cmd.Args) != 1 {
+			return "", fmt.Errorf("invalid args number: %s", cmd.FullName)
+		}
+		if l, err := s.handleZCard(cmd.Args[0]); err != nil {
+			return "", err
+		} else {
+			resp = l
+		}
+	default:
+		return "", fmt.Errorf("unknown command: %s", cmd.FullName)
+	}
+
+	return resp, nil
 }
 
-func (s *Server) handleLTrim(key string, start int, stop int) error {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		if len(val.Values) == 0 {
-			return nil
+func (s *Server) handlePing() statusReply {
+	return "pong"
+}
+
+func (s *Server) handleGet(key string) (any, error) {
+	v, ok, err := s.load(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case *List:
+		return strings.Join(v.All(), ","), nil
+	default:
+		return "", nil
+	}
+}
+
+func (s *Server) handleSet(m map[string]string) error {
+	for k, v := range m {
+		s.expires.Delete(k)
+		if err := s.storage.Put(k, v); err != nil {
+			return err
 		}
-		if start >= len(val.Values) {
-			val.Values = []string{}
-			return nil
+	}
+	return nil
+}
+
+// handleDel removes keys and returns the number of keys that existed.
+func (s *Server) handleDel(keys ...string) (int, error) {
+	var n int
+	for _, key := range keys {
+		_, ok, err := s.load(key)
+		if err != nil {
+			return n, err
 		}
-		if stop > len(val.Values)-1 {
-			stop = len(val.Values) - 1
+		if ok {
+			n++
 		}
-		if stop < 0 {
-			stop = len(val.Values) + stop
+		s.expires.Delete(key)
+		if err := s.storage.Delete(key); err != nil {
+			return n, err
 		}
-		val.Values = val.Values[start : stop+1]
-		return nil
+	}
+	return n, nil
+}
+
+// handleLPush returns the length of the list after the push.
+func (s *Server) handleLPush(key string, values ...string) (int, error) {
+	l, err := s.loadList(key)
+	if err != nil {
+		return 0, err
+	}
+	if l == nil {
+		l = NewList()
+	}
+	l.LPush(values...)
+	return l.Len(), s.storage.Put(key, l)
+}
+
+// handleRPush returns the length of the list after the push.
+func (s *Server) handleRPush(key string, values ...string) (int, error) {
+	l, err := s.loadList(key)
+	if err != nil {
+		return 0, err
+	}
+	if l == nil {
+		l = NewList()
+	}
+	l.RPush(values...)
+	return l.Len(), s.storage.Put(key, l)
+}
+
+// loadList returns the list stored at key, nil when the key does not exist.
+func (s *Server) loadList(key string) (*List, error) {
+	return loadValue[*List](s, key, "list")
+}
+
+// handlePop removes up to n elements from the head, or the tail when left is not set.
+func (s *Server) handlePop(key string, n int, left bool) ([]string, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return []string{}, err
+	}
+	var values []string
+	if left {
+		values = val.LPop(n)
 	} else {
-		return fmt.Errorf("invalid list type: %T", val)
+		values = val.RPop(n)
 	}
+	return values, s.update(key, val, val.Len())
 }
 
-func (s *Server) handleLIndex(key string, index int) (string, error) {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		if len(val.Values) == 0 {
-			return "", nil
-		}
-		if index > len(val.Values)-1 {
-			return "", nil
+func (s *Server) handleLSet(key string, index int, value string) error {
+	val, err := s.loadList(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return errors.New("no such key")
+	}
+	if !val.Set(index, value) {
+		return errors.New("index out of range")
+	}
+	return s.storage.Put(key, val)
+}
+
+func (s *Server) handleLInsert(key string, pivot string, value string, after bool) (int, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return 0, err
+	}
+	n := val.Insert(pivot, value, after)
+	if n < 0 {
+		return n, nil
+	}
+	return n, s.storage.Put(key, val)
+}
+
+func (s *Server) handleLRem(key string, count int, value string) (int, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return 0, err
+	}
+	removed := val.Rem(count, value)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.update(key, val, val.Len())
+}
+
+func (s *Server) handleLPos(key string, value string, rank, count, maxLen int) ([]int, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	return val.Pos(value, rank, count, maxLen), nil
+}
+
+// parseListEnd parses LEFT or RIGHT.
+func parseListEnd(arg string) (left bool, err error) {
+	switch strings.ToLower(arg) {
+	case "left":
+		return true, nil
+	case "right":
+		return false, nil
+	}
+	return false, fmt.Errorf("syntax error: %s", arg)
+}
+
+// handleLMove pops an element from one end of source and pushes it to one end
+// of destination, handleCommand holds the locks of both keys.
+func (s *Server) handleLMove(source, destination string, fromLeft, toLeft bool) (any, error) {
+	src, err := s.loadList(source)
+	if err != nil || src == nil {
+		return nil, err
+	}
+	dst := src
+	if destination != source {
+		// the type of destination is checked before anything changes
+		if dst, err = s.loadList(destination); err != nil {
+			return nil, err
 		}
-		if index < 0 {
-			index = len(val.Values) + index
+		if dst == nil {
+			dst = NewList()
 		}
-		return val.Values[index], nil
+	}
+	var values []string
+	if fromLeft {
+		values = src.LPop(1)
+	} else {
+		values = src.RPop(1)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if toLeft {
+		dst.LPush(values...)
 	} else {
-		return "", fmt.Errorf("invalid list type: %T", val)
+		dst.RPush(values...)
+	}
+	if destination != source {
+		if err := s.update(source, src, src.Len()); err != nil {
+			return nil, err
+		}
+	}
+	return values[0], s.storage.Put(destination, dst)
+}
+
+func (s *Server) handleLRange(key string, start int, stop int) ([]string, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return []string{}, err
 	}
+	return val.Range(start, stop), nil
+}
+
+func (s *Server) handleLTrim(key string, start int, stop int) error {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return err
+	}
+	return s.update(key, val, val.Trim(start, stop))
+}
+
+func (s *Server) handleLIndex(key string, index int) (string, error) {
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return "", err
+	}
+	v, _ := val.Index(index)
+	return v, nil
 }
 
 func (s *Server) handleLLen(key string) (int64, error) {
-	val, _ := s.store.LoadOrStore(key, &List{})
-	if val, ok := val.(*List); ok {
-		return int64(len(val.Values)), nil
-	} else {
-		return 0, fmt.Errorf("invalid list type: %T", val)
+	val, err := s.loadList(key)
+	if err != nil || val == nil {
+		return 0, err
 	}
+	return int64(val.Len()), nil
 }
 
-func (s *Server) handleKeys() []string {
+func (s *Server) handleKeys() ([]string, error) {
 	var keys []string
-	s.store.Range(func(key, _ any) bool {
-		keys = append(keys, key.(string))
-		return true
+	var err error
+	scanErr := s.storage.Scan(func(key string) bool {
+		var expired bool
+		if expired, err = s.expireKey(key); err == nil && !expired && !s.pastDeadline(key) {
+			keys = append(keys, key)
+		}
+		return err == nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
 	sort.Strings(keys)
-	return keys
+	return keys, nil
 }
 
-func (s *Server) handleExists(key string) string {
-	_, ok := s.store.Load(key)
-	if ok {
-		return "true"
-	} else {
-		return "false"
-	}
+func (s *Server) handleExists(key string) (bool, error) {
+	_, ok, err := s.load(key)
+	return ok, err
 }
 
-func (s *Server) handleSAdd(key string, values ...string) error {
-	raw, _ := s.store.LoadOrStore(key, &Set{Map: map[string]bool{}})
-	if val, ok := raw.(*Set); ok {
-		val.Add(values...)
-		return nil
-	} else {
-		return fmt.Errorf("invalid set type: %T", raw)
+// handleSAdd returns the number of members that were not in the set yet.
+func (s *Server) handleSAdd(key string, values ...string) (int, error) {
+	set, err := s.loadSet(key)
+	if err != nil {
+		return 0, err
+	}
+	if set == nil {
+		set = &Set{Map: map[string]bool{}}
 	}
+	n := set.Add(values...)
+	return n, s.storage.Put(key, set)
+}
+
+// loadSet returns the set stored at key, nil when the key does not exist.
+func (s *Server) loadSet(key string) (*Set, error) {
+	return loadValue[*Set](s, key, "set")
 }
 
 func (s *Server) handleLSMembers(key string) ([]string, error) {
-	raw, _ := s.store.LoadOrStore(key, &Set{Map: map[string]bool{}})
-	if val, ok := raw.(*Set); ok {
-		var keys []string
-		for k := range val.Map {
-			keys = append(keys, k)
-		}
-		return keys, nil
-	} else {
-		return nil, fmt.Errorf("invalid set type: %T", raw)
+	val, err := s.loadSet(key)
+	if err != nil || val == nil {
+		return []string{}, err
 	}
+	return val.Members(), nil
 }
 
 func (s *Server) handleLSIsMember(key string, val string) (bool, error) {
-	raw, _ := s.store.LoadOrStore(key, &Set{Map: map[string]bool{}})
-	if set, ok := raw.(*Set); ok {
-		return set.Has(val), nil
-	} else {
-		return false, fmt.Errorf("invalid set type: %T", raw)
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return false, err
+	}
+	return set.Has(val), nil
+}
+
+// handleSScan returns the members of a page of SSCAN that match the pattern,
+// a page may have no matching member before the walk ends.
+func (s *Server) handleSScan(key string, cursor uint64, match string, count int) ([]string, uint64, error) {
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return []string{}, 0, err
+	}
+	page, next := set.Scan(cursor, count)
+	if match == "" {
+		return page, next, nil
+	}
+	members := page[:0]
+	for _, m := range page {
+		if globMatch(match, m) {
+			members = append(members, m)
+		}
+	}
+	return members, next, nil
+}
+
+func (s *Server) handleSRem(key string, values ...string) (int, error) {
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return 0, err
+	}
+	removed, remaining := set.Remove(values...)
+	return removed, s.update(key, set, remaining)
+}
+
+func (s *Server) handleSCard(key string) (int, error) {
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return 0, err
+	}
+	return set.Len(), nil
+}
+
+func (s *Server) handleSPop(key string, count int, seed int64) ([]string, error) {
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return []string{}, err
+	}
+	members := set.Pop(count, seed)
+	return members, s.update(key, set, set.Len())
+}
+
+func (s *Server) handleSRandMember(key string, count int) ([]string, error) {
+	set, err := s.loadSet(key)
+	if err != nil || set == nil {
+		return []string{}, err
+	}
+	return set.Random(count), nil
+}
+
+// handleSMove moves member from the source set to the destination set.
+func (s *Server) handleSMove(source, destination string, member string) (bool, error) {
+	src, err := s.loadSet(source)
+	if err != nil {
+		return false, err
+	}
+	// the type of destination is checked before anything changes
+	dst, err := s.loadSet(destination)
+	if err != nil {
+		return false, err
+	}
+	if src == nil || !src.Has(member) {
+		return false, nil
+	}
+	if source == destination {
+		return true, nil
+	}
+	if dst == nil {
+		dst = &Set{Map: map[string]bool{}}
+	}
+	_, remaining := src.Remove(member)
+	dst.Add(member)
+	if err := s.update(source, src, remaining); err != nil {
+		return false, err
+	}
+	return true, s.storage.Put(destination, dst)
+}
+
+// handleSetAlgebra computes op over the sets of keys. handleCommand holds the
+// locks of all keys, so the sets are read at one instant.
+func (s *Server) handleSetAlgebra(op string, keys ...string) ([]string, error) {
+	sets := make([]*Set, 0, len(keys))
+	for _, key := range keys {
+		set, err := s.loadSet(key)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return setAlgebra(op, sets), nil
+}
+
+// handleSetAlgebraStore stores the result of op over the sets of keys at
+// destination, replacing its value and deadline, and returns its length. An
+// empty result deletes destination.
+func (s *Server) handleSetAlgebraStore(op string, destination string, keys ...string) (int, error) {
+	members, err := s.handleSetAlgebra(op, keys...)
+	if err != nil {
+		return 0, err
+	}
+	set := &Set{Map: make(map[string]bool, len(members))}
+	set.Add(members...)
+	s.expires.Delete(destination)
+	return len(members), s.update(destination, set, len(members))
+}
+
+// loadHash returns the hash stored at key, nil when the key does not exist.
+func (s *Server) loadHash(key string) (*Hash, error) {
+	return loadValue[*Hash](s, key, "hash")
+}
+
+func (s *Server) handleHSet(key string, fieldValues ...string) (int, error) {
+	h, err := s.loadHash(key)
+	if err != nil {
+		return 0, err
+	}
+	if h == nil {
+		h = &Hash{Map: map[string]string{}}
+	}
+	added := h.Set(fieldValues...)
+	return added, s.storage.Put(key, h)
+}
+
+func (s *Server) handleHGet(key string, field string) (any, error) {
+	h, err := s.loadHash(key)
+	if err != nil || h == nil {
+		return nil, err
+	}
+	if v, ok := h.Get(field); ok {
+		return v, nil
+	}
+	return nil, nil
+}
+
+func (s *Server) handleHDel(key string, fields ...string) (int, error) {
+	h, err := s.loadHash(key)
+	if err != nil || h == nil {
+		return 0, err
+	}
+	removed, remaining := h.Del(fields...)
+	return removed, s.update(key, h, remaining)
+}
+
+func (s *Server) handleHGetAll(key string) (mapReply, error) {
+	h, err := s.loadHash(key)
+	if err != nil || h == nil {
+		return mapReply{}, err
+	}
+	all := h.All()
+	fields := make([]string, 0, len(all))
+	for f := range all {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	m := make(mapReply, 0, len(fields))
+	for _, f := range fields {
+		m = append(m, mapEntry{Key: f, Value: all[f]})
+	}
+	return m, nil
+}
+
+func (s *Server) handleHIncrBy(key string, field string, n int64) (int64, error) {
+	h, err := s.loadHash(key)
+	if err != nil {
+		return 0, err
+	}
+	if h == nil {
+		h = &Hash{Map: map[string]string{}}
+	}
+	val, err := h.IncrBy(field, n)
+	if err != nil {
+		return 0, err
+	}
+	return val, s.storage.Put(key, h)
+}
+
+func (s *Server) handleHKeys(key string) ([]string, error) {
+	h, err := s.loadHash(key)
+	if err != nil || h == nil {
+		return []string{}, err
+	}
+	return h.Fields(), nil
+}
+
+func (s *Server) handleHLen(key string) (int64, error) {
+	h, err := s.loadHash(key)
+	if err != nil || h == nil {
+		return 0, err
+	}
+	return int64(h.Len()), nil
+}
+
+// loadZSet returns the sorted set stored at key, nil when the key does not exist.
+func (s *Server) loadZSet(key string) (*ZSet, error) {
+	return loadValue[*ZSet](s, key, "zset")
+}
+
+func (s *Server) handleZAdd(key string, members ...ZMember) (int, error) {
+	z, err := s.loadZSet(key)
+	if err != nil {
+		return 0, err
+	}
+	if z == nil {
+		z = NewZSet()
+	}
+	added := z.Add(members...)
+	return added, s.storage.Put(key, z)
+}
+
+func (s *Server) handleZRem(key string, members ...string) (int, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	removed, remaining := z.Rem(members...)
+	return removed, s.update(key, z, remaining)
+}
+
+func (s *Server) handleZScore(key string, member string) (any, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return nil, err
+	}
+	if score, ok := z.Score(member); ok {
+		return formatScore(score), nil
+	}
+	return nil, nil
+}
+
+func (s *Server) handleZRank(key string, member string, reverse bool) (any, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return nil, err
+	}
+	if rank, ok := z.Rank(member, reverse); ok {
+		return int64(rank), nil
+	}
+	return nil, nil
+}
+
+func (s *Server) handleZRange(key string, start int, stop int, reverse bool) ([]ZMember, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return nil, err
+	}
+	return z.Range(start, stop, reverse), nil
+}
+
+func (s *Server) handleZRangeByScore(key string, min, max zsetBound, offset, count int) ([]ZMember, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return nil, err
+	}
+	return z.RangeByScore(min, max, offset, count), nil
+}
+
+func (s *Server) handleZIncrBy(key string, member string, delta float64) (float64, error) {
+	z, err := s.loadZSet(key)
+	if err != nil {
+		return 0, err
+	}
+	if z == nil {
+		z = NewZSet()
+	}
+	score, err := z.IncrBy(member, delta)
+	if err != nil {
+		return 0, err
+	}
+	return score, s.storage.Put(key, z)
+}
+
+func (s *Server) handleZCard(key string) (int64, error) {
+	z, err := s.loadZSet(key)
+	if err != nil || z == nil {
+		return 0, err
 	}
+	return int64(z.Len()), nil
 }
@@ -1,18 +1,45 @@
 package kvstore
 
-import "sync"
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 type Set struct {
 	Map map[string]bool
 	sync.RWMutex
+	// scanIndex is the members in the order Scan walks them, it is built by
+	// the first Scan and dropped by writes
+	scanIndex []hashedMember
 }
 
-func (s *Set) Add(values ...string) {
+type hashedMember struct {
+	member string
+	hash   uint64
+}
+
+// Add adds values and returns the number of values that were not members.
+func (s *Set) Add(values ...string) int {
 	s.RWMutex.Lock()
 	defer s.RWMutex.Unlock()
+	var n int
 	for _, v := range values {
-		s.Map[v] = true
+		if !s.Map[v] {
+			s.Map[v] = true
+			n++
+		}
 	}
+	if n > 0 {
+		s.scanIndex = nil
+	}
+	return n
 }
 
 func (s *Set) Has(val string) bool {
@@ -20,3 +47,251 @@ func (s *Set) Has(val string) bool {
 	defer s.RUnlock()
 	return s.Map[val]
 }
+
+// Members returns a copy of the members.
+func (s *Set) Members() []string {
+	s.RLock()
+	defer s.RUnlock()
+	members := make([]string, 0, len(s.Map))
+	for m := range s.Map {
+		members = append(members, m)
+	}
+	return members
+}
+
+func (s *Set) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.Map)
+}
+
+// Remove removes values and returns the number of removed members and the remaining length.
+func (s *Set) Remove(values ...string) (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	removed := 0
+	for _, v := range values {
+		if s.Map[v] {
+			delete(s.Map, v)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.scanIndex = nil
+	}
+	return removed, len(s.Map)
+}
+
+// Random returns count distinct members, all of them when count exceeds the
+// length, or -count members which may repeat when count is negative.
+func (s *Set) Random(count int) []string {
+	members := s.Members()
+	if len(members) == 0 {
+		return []string{}
+	}
+	if count < 0 {
+		// the count comes from the client, the capacity does not
+		picked := make([]string, 0, min(-count, len(members)))
+		for i := 0; i < -count; i++ {
+			picked = append(picked, members[rand.Intn(len(members))])
+		}
+		return picked
+	}
+	count = min(count, len(members))
+	// a partial Fisher-Yates shuffle
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
+
+// Pop removes and returns up to count members. The members with the lowest
+// rank for seed are popped, so the same set and seed always pop the same
+// members whatever order the map is walked in.
+func (s *Set) Pop(count int, seed int64) []string {
+	s.Lock()
+	defer s.Unlock()
+	if count >= len(s.Map) {
+		popped := make([]string, 0, len(s.Map))
+		for m := range s.Map {
+			popped = append(popped, m)
+		}
+		clear(s.Map)
+		s.scanIndex = nil
+		return popped
+	}
+	// a max-heap of the count lowest ranks seen so far
+	picked := make(rankHeap, 0, count)
+	for m := range s.Map {
+		r := rankedMember{member: m, rank: popRank(uint64(seed), m)}
+		if len(picked) < count {
+			heap.Push(&picked, r)
+		} else if count > 0 && r.less(picked[0]) {
+			picked[0] = r
+			heap.Fix(&picked, 0)
+		}
+	}
+	popped := make([]string, 0, len(picked))
+	for _, r := range picked {
+		delete(s.Map, r.member)
+		popped = append(popped, r.member)
+	}
+	if len(popped) > 0 {
+		s.scanIndex = nil
+	}
+	return popped
+}
+
+// popRank is the FNV-1a hash of seed and member.
+func popRank(seed uint64, member string) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h = (h ^ (seed >> (8 * i) & 0xff)) * prime
+	}
+	for i := 0; i < len(member); i++ {
+		h = (h ^ uint64(member[i])) * prime
+	}
+	return h
+}
+
+type rankedMember struct {
+	member string
+	rank   uint64
+}
+
+func (r rankedMember) less(o rankedMember) bool {
+	return r.rank < o.rank || (r.rank == o.rank && r.member < o.member)
+}
+
+type rankHeap []rankedMember
+
+func (h rankHeap) Len() int           { return len(h) }
+func (h rankHeap) Less(i, j int) bool { return h[j].less(h[i]) }
+func (h rankHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rankHeap) Push(x any)        { *h = append(*h, x.(rankedMember)) }
+func (h *rankHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// defaultScanCount is the page size of SSCAN without COUNT.
+const defaultScanCount = 10
+
+// memberHash orders the members for Scan.
+func memberHash(member string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(member))
+	return h.Sum64()
+}
+
+// Scan returns about count members from cursor on and the cursor of the next
+// call, 0 once every member was returned. Members are walked in the order of
+// their hash and the cursor is the hash to continue from, so a member in the
+// set for the whole walk is returned once whatever changes meanwhile. The
+// order is kept until the next write, so a walk of an unchanged set sorts it
+// once and every call resumes at its cursor.
+func (s *Set) Scan(cursor uint64, count int) ([]string, uint64) {
+	// the index is built by readers too
+	s.Lock()
+	defer s.Unlock()
+	if s.scanIndex == nil {
+		s.scanIndex = make([]hashedMember, 0, len(s.Map))
+		for m := range s.Map {
+			s.scanIndex = append(s.scanIndex, hashedMember{member: m, hash: memberHash(m)})
+		}
+		slices.SortFunc(s.scanIndex, func(a, b hashedMember) int {
+			return cmp.Compare(a.hash, b.hash)
+		})
+	}
+	index := s.scanIndex
+	start, _ := slices.BinarySearchFunc(index, cursor, func(m hashedMember, cursor uint64) int {
+		return cmp.Compare(m.hash, cursor)
+	})
+	end := start + min(count, len(index)-start)
+	// members with the same hash are returned together, the cursor can not split them
+	for end > start && end < len(index) && index[end].hash == index[end-1].hash {
+		end++
+	}
+	members := make([]string, 0, end-start)
+	for _, m := range index[start:end] {
+		members = append(members, m.member)
+	}
+	if end == len(index) {
+		return members, 0
+	}
+	return members, index[end-1].hash + 1
+}
+
+// setAlgebra returns the intersection, union or difference of sets, op is
+// "inter", "union" or "diff". A nil set is an empty one, the difference is
+// the members of the first set in none of the others.
+func setAlgebra(op string, sets []*Set) []string {
+	if len(sets) == 0 || (op != "union" && sets[0] == nil) {
+		return []string{}
+	}
+	result := map[string]bool{}
+	switch op {
+	case "union":
+		for _, set := range sets {
+			if set != nil {
+				for _, m := range set.Members() {
+					result[m] = true
+				}
+			}
+		}
+	case "inter", "diff":
+		for _, m := range sets[0].Members() {
+			result[m] = true
+		}
+		for _, set := range sets[1:] {
+			if op == "inter" && set == nil {
+				return []string{}
+			}
+			if set == nil {
+				continue
+			}
+			for m := range result {
+				if set.Has(m) == (op == "diff") {
+					delete(result, m)
+				}
+			}
+		}
+	}
+	members := make([]string, 0, len(result))
+	for m := range result {
+		members = append(members, m)
+	}
+	return members
+}
+
+// seedSPop rewrites SPOP key [count] to SPOP key [count] SEED seed with a
+// random seed, so the members popped only depend on the set and the command,
+// and replaying it from the AOF or the Raft log pops the same members. SEED
+// is internal, a client sending it gets an error.
+func seedSPop(cmd *Cmd) (*Cmd, error) {
+	if cmd.Name != "spop" {
+		return cmd, nil
+	}
+	if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
+		return nil, fmt.Errorf("invalid args number: %s", cmd.FullName)
+	}
+	args := append([]string{cmd.Name}, cmd.Args...)
+	return NewCmdArgs(append(args, "SEED", strconv.FormatInt(rand.Int63(), 10))), nil
+}
+
+// parseSPopSeed splits the SEED seed option execute adds off the SPOP
+// arguments, a random seed is used without it.
+func parseSPopSeed(args []string) ([]string, int64, error) {
+	if len(args) < 3 || !strings.EqualFold(args[len(args)-2], "seed") {
+		return args, rand.Int63(), nil
+	}
+	seed, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid seed value: %s", args[len(args)-1])
+	}
+	return args[:len(args)-2], seed, nil
+}
@@ -0,0 +1,27 @@
+package kvstore_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	kvstore "github.com/zhan3333/kystore"
+)
+
+// BenchmarkSetScan walks sets of growing sizes with the default page size, the
+// time per page stays flat since every call resumes at its cursor.
+func BenchmarkSetScan(b *testing.B) {
+	for _, size := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			set := &kvstore.Set{Map: map[string]bool{}}
+			for i := 0; i < size; i++ {
+				set.Add(strconv.Itoa(i))
+			}
+			var cursor uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, cursor = set.Scan(cursor, 10)
+			}
+		})
+	}
+}
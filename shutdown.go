@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultShutdownTimeout is how long the connections may run on shutdown by default.
+const defaultShutdownTimeout = 5 * time.Second
+
+// shutdownMode tells whether an RDB snapshot is written on shutdown.
+type shutdownMode int
+
+const (
+	// shutdownDefault writes a snapshot when the backup type is RDB
+	shutdownDefault shutdownMode = iota
+	shutdownSave
+	shutdownNoSave
+)
+
+// handleShutdown asks Run to shut down: SHUTDOWN [SAVE|NOSAVE]. SAVE writes an
+// RDB snapshot whatever the backup type, NOSAVE skips it, the AOF is always
+// fsynced.
+func (s *Server) handleShutdown(args []string) (statusReply, error) {
+	mode := shutdownDefault
+	if len(args) == 1 {
+		switch strings.ToLower(args[0]) {
+		case "save":
+			if s.backupPath == "" {
+				return "", errors.New("backup is not enabled, there is nowhere to save")
+			}
+			mode = shutdownSave
+		case "nosave":
+			mode = shutdownNoSave
+		default:
+			return "", fmt.Errorf("syntax error: %s", args[0])
+		}
+	}
+	select {
+	case s.shutdownCh <- mode:
+	default:
+		// a shutdown is already requested
+	}
+	return statusOK, nil
+}
+
+// shutdown runs once the listener is closed. It fails the next read of every
+// connection and wakes up the blocked commands, so the connections stop after
+// the commands already received, and closes those still running after timeout.
+// Then it stops the background jobs and saves a final RDB snapshot for
+// SHUTDOWN SAVE, or by default when the backup is RDB.
+func (s *Server) shutdown(cancel context.CancelFunc, mode shutdownMode, timeout time.Duration) {
+	log.Printf("Shutting down %s", s.addr)
+	// blocked commands reply an error instead of waiting for the timeout
+	close(s.closing)
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		s.connsMu.Lock()
+		log.Printf("Closing %d connections still running after %s", len(s.conns), timeout)
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.connsMu.Unlock()
+		<-drained
+	}
+
+	s.stopBackground(cancel)
+	if mode == shutdownSave || (mode == shutdownDefault && s.BackupType == BackupRDB) {
+		if err := s.WriteBackup(); err != nil {
+			log.Printf("save snapshot on shutdown failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package kvstore
+
+import "sync"
+
+// A snapshot captures the keyspace at one logical instant while commands keep
+// running. Starting a snapshot waits for the commands in flight, which hold
+// cmdMu for reading, and records the AOF offset at that cut. From then on a
+// command preserves a copy of every key it touches before changing it, unless
+// the snapshot already visited that key. The snapshot writes the preserved
+// copy of a key when there is one, and a copy of the live value otherwise.
+type cowSnapshot struct {
+	mu sync.Mutex
+	// saved holds the values of keys changed since the cut, nil when the key did not exist
+	saved   map[string]*savedValue
+	visited map[string]bool
+}
+
+type savedValue struct {
+	value    any
+	expireAt int64
+}
+
+// copyValue returns a deep copy of a stored value.
+func copyValue(v any) any {
+	switch v := v.(type) {
+	case *List:
+		return NewList(v.All()...)
+	case *Set:
+		members := v.Members()
+		set := &Set{Map: make(map[string]bool, len(members))}
+		set.Add(members...)
+		return set
+	case *Hash:
+		return &Hash{Map: v.All()}
+	case *ZSet:
+		z := NewZSet()
+		z.Add(v.Members()...)
+		return z
+	}
+	return v
+}
+
+// current returns a copy of the live value of key with its deadline, nil when
+// the key does not exist.
+func (s *Server) current(key string) (*savedValue, error) {
+	v, ok, err := s.storage.Get(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	sv := &savedValue{value: copyValue(v)}
+	if at, ok := s.expires.Load(key); ok {
+		sv.expireAt = at.(int64)
+	}
+	return sv, nil
+}
+
+// preserve saves the value of key for the running snapshot before it changes.
+func (s *Server) preserve(key string) error {
+	snap := s.snapshot.Load()
+	if snap == nil {
+		return nil
+	}
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.visited[key] {
+		return nil
+	}
+	if _, ok := snap.saved[key]; ok {
+		return nil
+	}
+	sv, err := s.current(key)
+	if err != nil {
+		return err
+	}
+	snap.saved[key] = sv
+	return nil
+}
+
+// preserveKeys preserves the keys cmd may change, read commands are included
+// since they lazily expire keys.
+func (s *Server) preserveKeys(cmd *Cmd) error {
+	if s.snapshot.Load() == nil {
+		return nil
+	}
+	for _, key := range commandKeys(cmd) {
+		if err := s.preserve(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beginSnapshot makes a cut and returns the AOF offset at that instant, atCut
+// runs while no command is running.
+func (s *Server) beginSnapshot(atCut func()) int64 {
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	s.snapshot.Store(&cowSnapshot{saved: map[string]*savedValue{}, visited: map[string]bool{}})
+	if atCut != nil {
+		atCut()
+	}
+	if s.aof == nil {
+		return 0
+	}
+	return s.aof.offset()
+}
+
+func (s *Server) endSnapshot() {
+	s.snapshot.Store(nil)
+}
+
+// eachSnapshotKey calls fn with every key as it was at the cut, keys whose
+// deadline has passed are included and left to the loader.
+func (s *Server) eachSnapshotKey(fn func(key string, value any, expireAt int64) error) error {
+	snap := s.snapshot.Load()
+	visit := func(key string) (*savedValue, error) {
+		snap.mu.Lock()
+		defer snap.mu.Unlock()
+		if snap.visited[key] {
+			return nil, nil
+		}
+		snap.visited[key] = true
+		if sv, ok := snap.saved[key]; ok {
+			delete(snap.saved, key)
+			return sv, nil
+		}
+		return s.current(key)
+	}
+	var err error
+	scanErr := s.storage.Scan(func(key string) bool {
+		var sv *savedValue
+		if sv, err = visit(key); sv != nil {
+			err = fn(key, sv.value, sv.expireAt)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	// keys deleted after the cut are only left in saved
+	snap.mu.Lock()
+	var deleted []string
+	for key := range snap.saved {
+		deleted = append(deleted, key)
+	}
+	snap.mu.Unlock()
+	for _, key := range deleted {
+		sv, err := visit(key)
+		if err != nil {
+			return err
+		}
+		if sv != nil {
+			if err := fn(key, sv.value, sv.expireAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
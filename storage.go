@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Storage keeps the keyspace. Values are a string, *List, *Set, *Hash or
+// *ZSet, deadlines are kept by the server. Get may return the stored value
+// itself or a copy, so a command changes a value while holding its key lock
+// and stores it back with Put. The server reads typed values with loadValue
+// and takes snapshots itself by saving a value before a command changes it,
+// see beginSnapshot, so a storage only keeps the current values.
+type Storage interface {
+	// Get returns the value of key, ok is false when the key does not exist.
+	Get(key string) (value any, ok bool, err error)
+	Put(key string, value any) error
+	Delete(key string) error
+	// Scan calls fn with every key until fn returns false, keys may be
+	// changed meanwhile.
+	Scan(fn func(key string) bool) error
+	Close() error
+}
+
+var errStorageClosed = errors.New("storage is closed")
+
+// MemoryStorage keeps the keyspace in memory, it is the default storage.
+type MemoryStorage struct {
+	m sync.Map
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (m *MemoryStorage) Get(key string) (any, bool, error) {
+	v, ok := m.m.Load(key)
+	return v, ok, nil
+}
+
+func (m *MemoryStorage) Put(key string, value any) error {
+	m.m.Store(key, value)
+	return nil
+}
+
+func (m *MemoryStorage) Delete(key string) error {
+	m.m.Delete(key)
+	return nil
+}
+
+func (m *MemoryStorage) Scan(fn func(key string) bool) error {
+	m.m.Range(func(key, _ any) bool {
+		return fn(key.(string))
+	})
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// loadValue returns the value of key as a T, the zero T when the key does not
+// exist. kind names the type in the error of a value of another type.
+func loadValue[T any](s *Server, key string, kind string) (T, error) {
+	var zero T
+	raw, ok, err := s.load(key)
+	if err != nil || !ok {
+		return zero, err
+	}
+	if val, ok := raw.(T); ok {
+		return val, nil
+	}
+	return zero, fmt.Errorf("invalid %s type: %T", kind, raw)
+}
+
+// update stores the changed value of key, a collection left with n == 0
+// elements deletes the key.
+func (s *Server) update(key string, value any, n int) error {
+	if n == 0 {
+		s.expires.Delete(key)
+		return s.storage.Delete(key)
+	}
+	return s.storage.Put(key, value)
+}
+
+// clearStorage deletes every key, such as the keys an LSMStorage kept from a
+// previous run.
+func (s *Server) clearStorage() error {
+	var err error
+	if scanErr := s.storage.Scan(func(key string) bool {
+		err = s.storage.Delete(key)
+		return err == nil
+	}); scanErr != nil {
+		return scanErr
+	}
+	return err
+}
@@ -0,0 +1,389 @@
+package kvstore
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	zsetMaxLevel = 32
+	zsetP        = 0.25
+)
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+type zsetLevel struct {
+	forward *zsetNode
+	// span is the number of nodes between this node and forward
+	span int
+}
+
+type zsetNode struct {
+	ZMember
+	backward *zsetNode
+	level    []zsetLevel
+}
+
+// ZSet is a sorted set: a skiplist ordered by score then member, plus a map
+// from member to score. The skiplist keeps spans so ranks are O(log n).
+type ZSet struct {
+	dict   map[string]float64
+	header *zsetNode
+	tail   *zsetNode
+	length int
+	level  int
+	sync.RWMutex
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{
+		dict:   map[string]float64{},
+		header: &zsetNode{level: make([]zsetLevel, zsetMaxLevel)},
+		level:  1,
+	}
+}
+
+// zsetBound is one end of a score range, Exclusive is set for the "(" syntax.
+type zsetBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// parseScore parses a score, "inf", "+inf" and "-inf" are accepted.
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.New("value is not a valid float")
+	}
+	return f, nil
+}
+
+// formatScore formats a score the way redis replies it.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseZSetBound(s string) (zsetBound, error) {
+	var b zsetBound
+	if strings.HasPrefix(s, "(") {
+		b.Exclusive = true
+		s = s[1:]
+	}
+	f, err := parseScore(s)
+	if err != nil {
+		return b, errors.New("min or max is not a float")
+	}
+	b.Value = f
+	return b, nil
+}
+
+func (b zsetBound) satisfiesMin(score float64) bool {
+	if b.Exclusive {
+		return score > b.Value
+	}
+	return score >= b.Value
+}
+
+func (b zsetBound) satisfiesMax(score float64) bool {
+	if b.Exclusive {
+		return score < b.Value
+	}
+	return score <= b.Value
+}
+
+func zsetRandomLevel() int {
+	level := 1
+	for level < zsetMaxLevel && rand.Float64() < zsetP {
+		level++
+	}
+	return level
+}
+
+// before reports whether n sorts before (score, member).
+func (n *zsetNode) before(score float64, member string) bool {
+	return n.Score < score || (n.Score == score && n.Member < member)
+}
+
+func (z *ZSet) insert(score float64, member string) {
+	var update [zsetMaxLevel]*zsetNode
+	var rank [zsetMaxLevel]int
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		if i < z.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zsetRandomLevel()
+	if level > z.level {
+		for i := z.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = z.header
+			update[i].level[i].span = z.length
+		}
+		z.level = level
+	}
+	x = &zsetNode{ZMember: ZMember{Member: member, Score: score}, level: make([]zsetLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < z.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != z.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		z.tail = x
+	}
+	z.length++
+}
+
+func (z *ZSet) delete(score float64, member string) {
+	var update [zsetMaxLevel]*zsetNode
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.Score != score || x.Member != member {
+		return
+	}
+	for i := 0; i < z.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		z.tail = x.backward
+	}
+	for z.level > 1 && z.header.level[z.level-1].forward == nil {
+		z.level--
+	}
+	z.length--
+}
+
+// byRank returns the node at the 1-based rank.
+func (z *ZSet) byRank(rank int) *zsetNode {
+	x := z.header
+	traversed := 0
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// Add sets the score of members and returns the number of new members.
+func (z *ZSet) Add(members ...ZMember) int {
+	z.Lock()
+	defer z.Unlock()
+	added := 0
+	for _, m := range members {
+		if cur, ok := z.dict[m.Member]; ok {
+			if cur == m.Score {
+				continue
+			}
+			z.delete(cur, m.Member)
+		} else {
+			added++
+		}
+		z.insert(m.Score, m.Member)
+		z.dict[m.Member] = m.Score
+	}
+	return added
+}
+
+// IncrBy adds delta to the score of member, a missing member starts at 0.
+func (z *ZSet) IncrBy(member string, delta float64) (float64, error) {
+	z.Lock()
+	defer z.Unlock()
+	cur, ok := z.dict[member]
+	score := cur + delta
+	if math.IsNaN(score) {
+		return 0, errors.New("resulting score is not a number (NaN)")
+	}
+	if ok {
+		z.delete(cur, member)
+	}
+	z.insert(score, member)
+	z.dict[member] = score
+	return score, nil
+}
+
+// Rem removes members and returns the number of removed members and the remaining length.
+func (z *ZSet) Rem(members ...string) (int, int) {
+	z.Lock()
+	defer z.Unlock()
+	removed := 0
+	for _, m := range members {
+		if score, ok := z.dict[m]; ok {
+			z.delete(score, m)
+			delete(z.dict, m)
+			removed++
+		}
+	}
+	return removed, z.length
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	z.RLock()
+	defer z.RUnlock()
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Rank returns the 0-based rank of member, from the highest score when reverse is set.
+func (z *ZSet) Rank(member string, reverse bool) (int, bool) {
+	z.RLock()
+	defer z.RUnlock()
+	score, ok := z.dict[member]
+	if !ok {
+		return 0, false
+	}
+	x := z.header
+	rank := 0
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && (x.level[i].forward.before(score, member) || x.level[i].forward.Member == member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != z.header && x.Member == member {
+			break
+		}
+	}
+	if reverse {
+		return z.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// Range returns the members between the start and stop ranks, negative ranks
+// count from the end.
+func (z *ZSet) Range(start, stop int, reverse bool) []ZMember {
+	z.RLock()
+	defer z.RUnlock()
+	if start < 0 {
+		start = z.length + start
+	}
+	if stop < 0 {
+		stop = z.length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= z.length {
+		stop = z.length - 1
+	}
+	if start > stop || start >= z.length {
+		return []ZMember{}
+	}
+	members := make([]ZMember, 0, stop-start+1)
+	var x *zsetNode
+	if reverse {
+		x = z.byRank(z.length - start)
+	} else {
+		x = z.byRank(start + 1)
+	}
+	for i := start; i <= stop && x != nil; i++ {
+		members = append(members, x.ZMember)
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return members
+}
+
+// RangeByScore returns the members with a score between min and max, skipping
+// offset members and returning at most count members when count is not negative.
+// Like redis a negative offset returns no member.
+func (z *ZSet) RangeByScore(min, max zsetBound, offset, count int) []ZMember {
+	z.RLock()
+	defer z.RUnlock()
+	members := []ZMember{}
+	if offset < 0 {
+		return members
+	}
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !min.satisfiesMin(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+	for x = x.level[0].forward; x != nil && max.satisfiesMax(x.Score); x = x.level[0].forward {
+		if count == 0 {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		members = append(members, x.ZMember)
+		if count > 0 {
+			count--
+		}
+	}
+	return members
+}
+
+func (z *ZSet) Len() int {
+	z.RLock()
+	defer z.RUnlock()
+	return z.length
+}
+
+// Members returns all members ordered by score.
+func (z *ZSet) Members() []ZMember {
+	return z.Range(0, -1, false)
+}
+
+// zsetReply flattens members into a reply, each member is followed by its
+// score when withScores is set.
+func zsetReply(members []ZMember, withScores bool) []string {
+	reply := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		reply = append(reply, m.Member)
+		if withScores {
+			reply = append(reply, formatScore(m.Score))
+		}
+	}
+	return reply
+}